@@ -0,0 +1,18 @@
+//go:build linux || openbsd || solaris || aix
+
+package exporter
+
+import (
+	"io/fs"
+	"syscall"
+	"time"
+)
+
+// statAtime returns the access time of a file.
+func statAtime(info fs.FileInfo) (time.Time, bool) {
+	sb, ok := info.Sys().(*syscall.Stat_t)
+	if !ok {
+		return time.Time{}, false
+	}
+	return time.Unix(0, sb.Atim.Nano()), true
+}
@@ -0,0 +1,12 @@
+//go:build !linux && !openbsd && !solaris && !aix && !darwin && !freebsd && !netbsd && !dragonfly && !windows
+
+package exporter
+
+import (
+	"io/fs"
+	"time"
+)
+
+func statAtime(info fs.FileInfo) (time.Time, bool) {
+	return time.Time{}, false
+}
@@ -0,0 +1,18 @@
+//go:build windows
+
+package exporter
+
+import (
+	"io/fs"
+	"syscall"
+	"time"
+)
+
+// statAtime returns the access time of a file.
+func statAtime(info fs.FileInfo) (time.Time, bool) {
+	data, ok := info.Sys().(*syscall.Win32FileAttributeData)
+	if !ok {
+		return time.Time{}, false
+	}
+	return time.Unix(0, data.LastAccessTime.Nanoseconds()), true
+}
@@ -0,0 +1,183 @@
+/*
+ * Copyright (c) 2023 Gilles Chehade <gilles@poolp.org>
+ *
+ * Permission to use, copy, modify, and distribute this software for any
+ * purpose with or without fee is hereby granted, provided that the above
+ * copyright notice and this permission notice appear in all copies.
+ *
+ * THE SOFTWARE IS PROVIDED "AS IS" AND THE AUTHOR DISCLAIMS ALL WARRANTIES
+ * WITH REGARD TO THIS SOFTWARE INCLUDING ALL IMPLIED WARRANTIES OF
+ * MERCHANTABILITY AND FITNESS. IN NO EVENT SHALL THE AUTHOR BE LIABLE FOR
+ * ANY SPECIAL, DIRECT, INDIRECT, OR CONSEQUENTIAL DAMAGES OR ANY DAMAGES
+ * WHATSOEVER RESULTING FROM LOSS OF USE, DATA OR PROFITS, WHETHER IN AN
+ * ACTION OF CONTRACT, NEGLIGENCE OR OTHER TORTIOUS ACTION, ARISING OUT OF
+ * OR IN CONNECTION WITH THE USE OR PERFORMANCE OF THIS SOFTWARE.
+ */
+
+package exporter
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+
+	"github.com/PlakarKorp/kloset/connectors"
+)
+
+// conflictPolicy tells what to do when a restored path already exists
+// in the target.  An existing directory never conflicts with a
+// restored directory: they are merged.
+type conflictPolicy int
+
+const (
+	conflictOverwrite conflictPolicy = iota
+	conflictReplace                  // overwrite, removing directories in the way
+	conflictSkipExisting
+	conflictKeepNewer
+	conflictRenameRestored
+	conflictFail
+)
+
+var (
+	errSkipped  = errors.New("skipped")
+	errConflict = errors.New("conflict")
+)
+
+func parseConflictPolicy(s string) (conflictPolicy, error) {
+	switch s {
+	case "", "overwrite":
+		return conflictOverwrite, nil
+	case "replace":
+		return conflictReplace, nil
+	case "skip-existing":
+		return conflictSkipExisting, nil
+	case "keep-newer":
+		return conflictKeepNewer, nil
+	case "rename-restored":
+		return conflictRenameRestored, nil
+	case "fail":
+		return conflictFail, nil
+	}
+	return 0, fmt.Errorf("invalid conflict policy %q", s)
+}
+
+// destination returns where the record should be restored, applying
+// the conflict policy if pathname already exists.
+func (p *FSExporter) destination(record *connectors.Record, pathname string) (string, error) {
+	existing, err := os.Lstat(pathname)
+	if err != nil {
+		if errors.Is(err, fs.ErrNotExist) {
+			return pathname, nil
+		}
+		return "", err
+	}
+	return p.resolveConflict(record, pathname, existing)
+}
+
+func (p *FSExporter) resolveConflict(record *connectors.Record, pathname string, existing fs.FileInfo) (string, error) {
+	switch p.conflict {
+	case conflictSkipExisting:
+		return "", fmt.Errorf("%w: destination already exists", errSkipped)
+
+	case conflictKeepNewer:
+		if existing.ModTime().After(record.FileInfo.ModTime()) {
+			return "", fmt.Errorf("%w: destination is newer", errSkipped)
+		}
+
+	case conflictRenameRestored:
+		for n := 1; ; n++ {
+			candidate := fmt.Sprintf("%s.restored-%d", pathname, n)
+			if _, err := os.Lstat(candidate); err != nil {
+				if errors.Is(err, fs.ErrNotExist) {
+					return candidate, nil
+				}
+				return "", err
+			}
+		}
+
+	case conflictFail:
+		return "", fmt.Errorf("%w: %s already exists", errConflict, pathname)
+	}
+
+	// Overwriting: regular files are renamed over the destination,
+	// everything else needs the way cleared first.  Only replacing
+	// removes a directory with content.
+	fileinfo := record.FileInfo
+	if existing.IsDir() {
+		if p.conflict != conflictReplace {
+			empty, err := isEmptyDir(pathname)
+			if err != nil {
+				return "", err
+			}
+			if !empty {
+				return "", fmt.Errorf("%w: %s is a directory that isn't empty, it's only removed with conflict=replace", errSkipped, pathname)
+			}
+		}
+		if err := os.RemoveAll(pathname); err != nil {
+			return "", err
+		}
+	} else if !fileinfo.Mode().IsRegular() || fileinfo.Nlink() > 1 {
+		if err := os.Remove(pathname); err != nil {
+			return "", err
+		}
+	}
+	return pathname, nil
+}
+
+// directory creates the directory for record if needed.  It reports
+// whether the directory permissions must be patched once the restore
+// is done.  An existing directory left alone by the conflict policy is
+// reported as skipped, so that it doesn't get the snapshot's extended
+// attributes either; its content is still restored.
+func (p *FSExporter) directory(record *connectors.Record, pathname string) (bool, error) {
+	existing, err := os.Lstat(pathname)
+	if err != nil && !errors.Is(err, fs.ErrNotExist) {
+		return false, err
+	}
+
+	if err == nil && existing.IsDir() {
+		switch p.conflict {
+		case conflictSkipExisting:
+			return false, fmt.Errorf("%w: destination already exists", errSkipped)
+		case conflictKeepNewer:
+			if existing.ModTime().After(record.FileInfo.ModTime()) {
+				return false, fmt.Errorf("%w: destination is newer", errSkipped)
+			}
+		}
+		_ = os.Chmod(pathname, 0700)
+		return true, nil
+	}
+
+	if err == nil {
+		target, err := p.resolveConflict(record, pathname, existing)
+		if err != nil {
+			return false, err
+		}
+		if target != pathname {
+			return false, fmt.Errorf("can't restore directory under another name, %s is in the way", pathname)
+		}
+	}
+
+	if err := os.Mkdir(pathname, 0700); err != nil {
+		return false, err
+	}
+	return true, nil
+}
+
+func isEmptyDir(pathname string) (bool, error) {
+	fp, err := os.Open(pathname)
+	if err != nil {
+		return false, err
+	}
+	defer fp.Close()
+
+	if _, err := fp.Readdirnames(1); err != nil {
+		if err == io.EOF {
+			return true, nil
+		}
+		return false, err
+	}
+	return false, nil
+}
@@ -0,0 +1,181 @@
+/*
+ * Copyright (c) 2023 Gilles Chehade <gilles@poolp.org>
+ *
+ * Permission to use, copy, modify, and distribute this software for any
+ * purpose with or without fee is hereby granted, provided that the above
+ * copyright notice and this permission notice appear in all copies.
+ *
+ * THE SOFTWARE IS PROVIDED "AS IS" AND THE AUTHOR DISCLAIMS ALL WARRANTIES
+ * WITH REGARD TO THIS SOFTWARE INCLUDING ALL IMPLIED WARRANTIES OF
+ * MERCHANTABILITY AND FITNESS. IN NO EVENT SHALL THE AUTHOR BE LIABLE FOR
+ * ANY SPECIAL, DIRECT, INDIRECT, OR CONSEQUENTIAL DAMAGES OR ANY DAMAGES
+ * WHATSOEVER RESULTING FROM LOSS OF USE, DATA OR PROFITS, WHETHER IN AN
+ * ACTION OF CONTRACT, NEGLIGENCE OR OTHER TORTIOUS ACTION, ARISING OUT OF
+ * OR IN CONNECTION WITH THE USE OR PERFORMANCE OF THIS SOFTWARE.
+ */
+
+package exporter
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strconv"
+	"time"
+
+	"github.com/PlakarKorp/kloset/connectors"
+)
+
+// deltaMode controls whether regular files already present in the
+// target with the expected size, mode and modification time (and
+// optionally content) are left in place instead of being rewritten.
+type deltaMode struct {
+	enabled   bool
+	content   bool
+	tolerance time.Duration // 0 means probing the target filesystem
+}
+
+func parseDeltaMode(config map[string]string) (deltaMode, error) {
+	var d deltaMode
+	var err error
+
+	if v, ok := config["delta"]; ok {
+		if d.enabled, err = strconv.ParseBool(v); err != nil {
+			return d, fmt.Errorf("invalid delta: %w", err)
+		}
+	}
+	if v, ok := config["delta_compare_content"]; ok {
+		if d.content, err = strconv.ParseBool(v); err != nil {
+			return d, fmt.Errorf("invalid delta_compare_content: %w", err)
+		}
+	}
+	if v, ok := config["delta_time_tolerance"]; ok {
+		if d.tolerance, err = time.ParseDuration(v); err != nil || d.tolerance < 0 {
+			return d, fmt.Errorf("invalid delta_time_tolerance %q", v)
+		}
+	}
+	return d, nil
+}
+
+// timeTolerance returns how far apart two modification times may be
+// and still be considered equal: the configured tolerance, or the
+// granularity of the filesystem holding dir.
+func (p *FSExporter) timeTolerance(dir string) time.Duration {
+	p.deltaOnce.Do(func() {
+		if p.delta.tolerance == 0 {
+			p.delta.tolerance = timeGranularity(dir)
+		}
+		p.delta.tolerance = max(p.delta.tolerance, timeResolution)
+	})
+	return p.delta.tolerance
+}
+
+// timeGranularity finds out how the filesystem holding dir rounds
+// modification times, by setting one whose fractional part is all
+// nines and reading it back.
+func timeGranularity(dir string) time.Duration {
+	fp, err := os.CreateTemp(dir, ".plakar-*")
+	if err != nil {
+		return 0
+	}
+	name := fp.Name()
+	fp.Close()
+	defer os.Remove(name)
+
+	want := time.Unix(1_000_000_001, 999_999_999)
+	if err := Lutimes(name, want, want); err != nil {
+		return 0
+	}
+	st, err := os.Lstat(name)
+	if err != nil {
+		return 0
+	}
+	if diff := want.Sub(st.ModTime()).Abs(); diff != 0 {
+		return diff + time.Nanosecond
+	}
+	return 0
+}
+
+// unchanged reports whether pathname already holds the file described
+// by record.  When the content is compared and found to differ, the
+// record reader is replaced so that the bytes already consumed are not
+// lost.
+func (p *FSExporter) unchanged(record *connectors.Record, pathname string) (bool, error) {
+	st, err := os.Lstat(pathname)
+	if err != nil {
+		return false, nil
+	}
+
+	fileinfo := record.FileInfo
+	if !st.Mode().IsRegular() || st.Mode() != fileinfo.Mode() || st.Size() != fileinfo.Size() {
+		return false, nil
+	}
+
+	tolerance := p.timeTolerance(filepath.Dir(pathname))
+	if st.ModTime().Sub(fileinfo.ModTime()).Abs() >= tolerance {
+		return false, nil
+	}
+
+	if !p.delta.content {
+		return true, nil
+	}
+	return sameContent(record, pathname)
+}
+
+func sameContent(record *connectors.Record, pathname string) (bool, error) {
+	fp, err := os.Open(pathname)
+	if err != nil {
+		return false, err
+	}
+
+	want := make([]byte, 64*1024)
+	have := make([]byte, 64*1024)
+	var offset int64
+
+	for {
+		n, rerr := io.ReadFull(record.Reader, want)
+		if rerr != nil && rerr != io.EOF && rerr != io.ErrUnexpectedEOF {
+			fp.Close()
+			return false, rerr
+		}
+
+		m, _ := io.ReadFull(fp, have[:n])
+		if m != n || !bytes.Equal(want[:n], have[:n]) {
+			// Replay what was already read from the record: the
+			// matching prefix from the file, then the buffer.
+			record.Reader = &replayReader{
+				Reader: io.MultiReader(io.NewSectionReader(fp, 0, offset),
+					bytes.NewReader(want[:n]), record.Reader),
+				closers: []io.Closer{fp, record.Reader},
+			}
+			return false, nil
+		}
+		offset += int64(n)
+
+		if rerr != nil {
+			// The record is exhausted, the file must be too.
+			m, err := fp.Read(have[:1])
+			fp.Close()
+			if m != 0 || !errors.Is(err, io.EOF) {
+				return false, fmt.Errorf("%s changed during comparison", pathname)
+			}
+			return true, nil
+		}
+	}
+}
+
+type replayReader struct {
+	io.Reader
+	closers []io.Closer
+}
+
+func (r *replayReader) Close() error {
+	var errs []error
+	for _, c := range r.closers {
+		errs = append(errs, c.Close())
+	}
+	return errors.Join(errs...)
+}
@@ -0,0 +1,61 @@
+/*
+ * Copyright (c) 2023 Gilles Chehade <gilles@poolp.org>
+ *
+ * Permission to use, copy, modify, and distribute this software for any
+ * purpose with or without fee is hereby granted, provided that the above
+ * copyright notice and this permission notice appear in all copies.
+ *
+ * THE SOFTWARE IS PROVIDED "AS IS" AND THE AUTHOR DISCLAIMS ALL WARRANTIES
+ * WITH REGARD TO THIS SOFTWARE INCLUDING ALL IMPLIED WARRANTIES OF
+ * MERCHANTABILITY AND FITNESS. IN NO EVENT SHALL THE AUTHOR BE LIABLE FOR
+ * ANY SPECIAL, DIRECT, INDIRECT, OR CONSEQUENTIAL DAMAGES OR ANY DAMAGES
+ * WHATSOEVER RESULTING FROM LOSS OF USE, DATA OR PROFITS, WHETHER IN AN
+ * ACTION OF CONTRACT, NEGLIGENCE OR OTHER TORTIOUS ACTION, ARISING OUT OF
+ * OR IN CONNECTION WITH THE USE OR PERFORMANCE OF THIS SOFTWARE.
+ */
+
+package exporter
+
+import (
+	"sync"
+
+	"github.com/PlakarKorp/integration-fs/storage"
+)
+
+// dirSyncer collects the directories whose entries changed during the
+// restore, so that they can all be synced at once at the end.
+type dirSyncer struct {
+	enabled bool
+
+	mu   sync.Mutex
+	dirs map[string]struct{}
+}
+
+func newDirSyncer(level storage.Durability) *dirSyncer {
+	return &dirSyncer{
+		enabled: level >= storage.DurabilityFull,
+		dirs:    make(map[string]struct{}),
+	}
+}
+
+func (d *dirSyncer) add(dir string) {
+	if !d.enabled {
+		return
+	}
+	d.mu.Lock()
+	d.dirs[dir] = struct{}{}
+	d.mu.Unlock()
+}
+
+func (d *dirSyncer) sync() error {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	for dir := range d.dirs {
+		if err := storage.SyncDir(dir); err != nil {
+			return err
+		}
+		delete(d.dirs, dir)
+	}
+	return nil
+}
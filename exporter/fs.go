@@ -18,13 +18,17 @@ package exporter
 
 import (
 	"context"
+	"errors"
 	"fmt"
 	"io"
 	"os"
 	"path/filepath"
+	"strconv"
 	"strings"
 	"sync"
+	"time"
 
+	"github.com/PlakarKorp/integration-fs/storage"
 	"github.com/PlakarKorp/kloset/connectors"
 	"github.com/PlakarKorp/kloset/connectors/exporter"
 	"github.com/PlakarKorp/kloset/location"
@@ -34,12 +38,33 @@ import (
 )
 
 type FSExporter struct {
-	opts    *connectors.Options
-	rootDir string
+	opts     *connectors.Options
+	rootDir  string
+	owners   *ownerMapper
+	conflict conflictPolicy
+	mirror   *mirror
+	delta    deltaMode
+	journal  *journal
+	sparse   sparseMode
+
+	durability storage.Durability
+	dirSync    *dirSyncer
 
 	hlCreate singleflight.Group // key -> ensures canonical exists, returns canonical abs path
 	hlCanon  sync.Map           // key -> canonical abs path string
 	hlMu     sync.Map           // key -> *sync.Mutex (serialize os.Link per key)
+
+	xattrMu      sync.Mutex
+	xattrs       map[string]*xattrState // abs path -> attributes awaiting their target
+	xattrSeen    bool                   // attribute records are being sent
+	xattrWriteMu sync.Mutex             // serializes making paths writable
+
+	atimeMu sync.Mutex
+	atimes  map[string]time.Time // recorded access times of directories
+
+	verifyTimes bool
+
+	deltaOnce sync.Once // probes the delta time tolerance
 }
 
 func init() {
@@ -55,9 +80,67 @@ func NewFSExporter(ctx context.Context, opts *connectors.Options, name string, c
 		return nil, fmt.Errorf("failed to absolutify root: %w", err)
 	}
 
+	owners, err := newOwnerMapper(config)
+	if err != nil {
+		return nil, err
+	}
+
+	conflict, err := parseConflictPolicy(config["conflict"])
+	if err != nil {
+		return nil, err
+	}
+
+	mirror, err := newMirror(config)
+	if err != nil {
+		return nil, err
+	}
+
+	delta, err := parseDeltaMode(config)
+	if err != nil {
+		return nil, err
+	}
+
+	durability, err := storage.ParseDurability(config["durability"])
+	if err != nil {
+		return nil, err
+	}
+
+	sparse, err := parseSparseMode(config["sparse"])
+	if err != nil {
+		return nil, err
+	}
+
+	var resume bool
+	if v, ok := config["resume"]; ok {
+		if resume, err = strconv.ParseBool(v); err != nil {
+			return nil, fmt.Errorf("invalid resume: %w", err)
+		}
+	}
+
+	var verifyTimes bool
+	if v, ok := config["verify_times"]; ok {
+		if verifyTimes, err = strconv.ParseBool(v); err != nil {
+			return nil, fmt.Errorf("invalid verify_times: %w", err)
+		}
+	}
+
 	return &FSExporter{
-		opts:    opts,
-		rootDir: absRoot,
+		opts:     opts,
+		rootDir:  absRoot,
+		owners:   owners,
+		conflict: conflict,
+		mirror:   mirror,
+		delta:    delta,
+		journal:  newJournal(absRoot, resume),
+		sparse:   sparse,
+
+		durability: durability,
+		dirSync:    newDirSyncer(durability),
+
+		xattrs: make(map[string]*xattrState),
+		atimes: make(map[string]time.Time),
+
+		verifyTimes: verifyTimes,
 	}, nil
 }
 
@@ -92,6 +175,12 @@ func (p *FSExporter) Export(ctx context.Context, records <-chan *connectors.Reco
 
 	dirPerms := make([]dirPerm, 0, 1024)
 
+	defer p.journal.close()
+	if err := p.journal.load(); err != nil {
+		return fmt.Errorf("failed to load restore journal: %w", err)
+	}
+	dirPerms = append(dirPerms, p.journal.dirs...)
+
 loop:
 	for {
 		select {
@@ -104,55 +193,78 @@ loop:
 				break loop
 			}
 
+			pathname := filepath.Join(p.rootDir, record.Pathname)
+
 			if record.Err != nil {
+				if isContained(p.rootDir, pathname) {
+					p.mirror.keepFailed(pathname)
+				}
 				results <- record.Ok()
 				continue
 			}
 
-			if record.IsXattr {
-				results <- record.Ok()
+			if !isContained(p.rootDir, pathname) {
+				results <- record.Error(fmt.Errorf("path %q escapes restore root", record.Pathname))
 				continue
 			}
 
-			pathname := filepath.Join(p.rootDir, record.Pathname)
-			if !isContained(p.rootDir, pathname) {
-				results <- record.Error(fmt.Errorf("path %q escapes restore root", record.Pathname))
+			if record.IsXattr {
+				p.xattrSending()
+				g.Go(func() error {
+					p.xattrRecord(record, pathname, results)
+					return nil
+				})
 				continue
 			}
 
+			p.mirror.keep(pathname)
+
 			if record.FileInfo.Lmode.IsDir() {
-				if err := os.Mkdir(pathname, 0700); err != nil {
-					if !os.IsExist(err) {
-						results <- record.Error(err)
-					} else {
-						_ = os.Chmod(pathname, 0700)
-						results <- record.Ok()
+				patch, err := p.directory(record, pathname)
+				if err != nil {
+					results <- record.Error(err)
+					if errors.Is(err, errSkipped) {
+						p.xattrCreated(record, pathname, "", results)
 					}
-				} else {
-					results <- record.Ok()
+					if errors.Is(err, errConflict) {
+						ret = err
+						break loop
+					}
+					continue
 				}
 
+				results <- record.Ok()
+				p.xattrCreated(record, pathname, pathname, results)
+
 				// later patching
-				dirPerms = append(dirPerms, dirPerm{
-					Pathname: pathname,
-					Fileinfo: record.FileInfo,
-				})
+				if patch {
+					dirPerms = append(dirPerms, dirPerm{
+						Pathname: pathname,
+						Fileinfo: record.FileInfo,
+					})
+					p.journal.directory(record.Pathname, record.FileInfo)
+					p.dirSync.add(pathname)
+					p.dirSync.add(filepath.Dir(pathname))
+				}
 
 				continue
 			}
 
 			g.Go(func() error {
-				var err error
-				if record.FileInfo.Lmode&os.ModeSymlink != 0 {
-					err = p.symlink(record, pathname)
-				} else if record.FileInfo.Lmode.IsRegular() {
-					err = p.file(record, pathname)
-				}
-
+				target, err := p.restore(record, pathname)
 				if err != nil {
 					results <- record.Error(err)
+					if errors.Is(err, errSkipped) {
+						p.xattrCreated(record, pathname, "", results)
+					}
+					if errors.Is(err, errConflict) {
+						return err
+					}
 				} else {
+					p.dirSync.add(filepath.Dir(target))
+					p.journalFile(record, target)
 					results <- record.Ok()
+					p.xattrCreated(record, pathname, target, results)
 				}
 				return nil
 			})
@@ -164,35 +276,91 @@ loop:
 		ret = err
 	}
 
+	p.xattrFlush(results)
+
+	// Only prune a complete restore, and before the directories get
+	// their final times.
+	if ret == nil {
+		ret = p.prune()
+	}
+
+	// The journal goes away before the directories get their final
+	// permissions and times, which would otherwise prevent its
+	// removal or be altered by it.
+	if ret == nil {
+		ret = p.journal.remove()
+	}
+
 	for i := len(dirPerms) - 1; i >= 0; i-- {
 		if err := p.permissions(dirPerms[i].Pathname, dirPerms[i].Fileinfo); err != nil {
 			return err
 		}
 	}
 
+	if err := p.dirSync.sync(); err != nil && ret == nil {
+		ret = err
+	}
+
 	return ret
 }
 
+// restore restores a non-directory record and returns the path it was
+// restored to.
+func (p *FSExporter) restore(record *connectors.Record, pathname string) (string, error) {
+	if p.resumed(record, pathname) {
+		p.adoptHardlink(record.FileInfo, pathname)
+		return pathname, nil
+	}
+
+	if p.delta.enabled && record.FileInfo.Lmode.IsRegular() {
+		same, err := p.unchanged(record, pathname)
+		if err != nil {
+			return "", err
+		}
+		if same {
+			p.adoptHardlink(record.FileInfo, pathname)
+			return pathname, p.fileMetadata(pathname, record.FileInfo)
+		}
+	}
+
+	target, err := p.destination(record, pathname)
+	if err != nil {
+		return "", err
+	}
+	p.mirror.keep(target)
+
+	if record.FileInfo.Lmode&os.ModeSymlink != 0 {
+		err = p.symlink(record, target)
+	} else if record.FileInfo.Lmode.IsRegular() {
+		err = p.file(record, target)
+	} else {
+		err = p.special(record, target)
+	}
+	return target, err
+}
+
 func (p *FSExporter) symlink(record *connectors.Record, pathname string) error {
 	if err := os.Symlink(record.Target, pathname); err != nil {
 		return err
 	}
 
 	fileinfo := record.FileInfo
-
-	if os.Geteuid() == 0 {
-		err := os.Lchown(pathname, int(fileinfo.Uid()), int(fileinfo.Gid()))
-		if err != nil {
-			return err
-		}
+	if err := p.chown(pathname, fileinfo); err != nil {
+		return err
 	}
 
-	return Lutimes(pathname, fileinfo.ModTime(), fileinfo.ModTime())
+	return p.setTimes(pathname, fileinfo.ModTime(), fileinfo.ModTime())
+}
+
+func (p *FSExporter) special(record *connectors.Record, pathname string) error {
+	if err := Mknod(pathname, record.FileInfo); err != nil {
+		return err
+	}
+	return p.permissions(pathname, record.FileInfo)
 }
 
 func (p *FSExporter) hardlink(record *connectors.Record, pathname string) error {
-	fileinfo := record.FileInfo
-	key := fmt.Sprintf("%d:%d", fileinfo.Dev(), fileinfo.Ino())
+	key := hardlinkKey(record.FileInfo)
 
 	v, err, _ := p.hlCreate.Do(key, func() (any, error) {
 		if v, ok := p.hlCanon.Load(key); ok {
@@ -201,7 +369,7 @@ func (p *FSExporter) hardlink(record *connectors.Record, pathname string) error
 		if err := p.writeAtomic(record, pathname); err != nil {
 			return "", err
 		}
-		p.hlCanon.Store(key, filepath.Join(p.rootDir, pathname))
+		p.hlCanon.Store(key, pathname)
 		return pathname, nil
 	})
 	if err != nil {
@@ -219,6 +387,18 @@ func (p *FSExporter) hardlink(record *connectors.Record, pathname string) error
 	return nil
 }
 
+func hardlinkKey(fileinfo objects.FileInfo) string {
+	return fmt.Sprintf("%d:%d", fileinfo.Dev(), fileinfo.Ino())
+}
+
+// adoptHardlink makes an already present pathname the canonical path
+// for its hardlink group, if it has none yet.
+func (p *FSExporter) adoptHardlink(fileinfo objects.FileInfo, pathname string) {
+	if fileinfo.Lnlink > 1 {
+		p.hlCanon.LoadOrStore(hardlinkKey(fileinfo), pathname)
+	}
+}
+
 func (p *FSExporter) file(record *connectors.Record, pathname string) error {
 	if record.FileInfo.Lnlink > 1 {
 		return p.hardlink(record, pathname)
@@ -240,11 +420,23 @@ func (p *FSExporter) writeAtomic(record *connectors.Record, pathname string) err
 		}
 	}()
 
-	if _, err := io.Copy(tmp, record.Reader); err != nil {
+	if p.isSparse(record.FileInfo) {
+		_, err = copySparse(tmp, record.Reader)
+	} else {
+		_, err = io.Copy(tmp, record.Reader)
+	}
+	if err != nil {
 		tmp.Close()
 		return err
 	}
 
+	if p.durability >= storage.DurabilityFile {
+		if err := tmp.Sync(); err != nil {
+			tmp.Close()
+			return err
+		}
+	}
+
 	if err := tmp.Close(); err != nil {
 		return err
 	}
@@ -255,13 +447,21 @@ func (p *FSExporter) writeAtomic(record *connectors.Record, pathname string) err
 
 	ok = true
 
-	fileinfo := record.FileInfo
+	return p.fileMetadata(pathname, record.FileInfo)
+}
+
+func (p *FSExporter) fileMetadata(pathname string, fileinfo objects.FileInfo) error {
+	// chown must come first: it clears the setuid and setgid bits.
+	if err := p.chown(pathname, fileinfo); err != nil {
+		return err
+	}
+
 	mode := fileinfo.Mode().Perm() | fileinfo.Mode()&(os.ModeSetuid|os.ModeSetgid|os.ModeSticky)
 	if err := os.Chmod(pathname, mode); err != nil {
 		return err
 	}
 
-	return Lutimes(pathname, fileinfo.ModTime(), fileinfo.ModTime())
+	return p.setTimes(pathname, fileinfo.ModTime(), fileinfo.ModTime())
 }
 
 func (p *FSExporter) permissions(pathname string, fileinfo objects.FileInfo) error {
@@ -273,13 +473,21 @@ func (p *FSExporter) permissions(pathname string, fileinfo objects.FileInfo) err
 			return err
 		}
 	}
-	if os.Geteuid() == 0 {
-		if err := os.Lchown(pathname, int(fileinfo.Uid()), int(fileinfo.Gid())); err != nil {
-			return err
-		}
+	if err := p.chown(pathname, fileinfo); err != nil {
+		return err
 	}
-	if err := Lutimes(pathname, fileinfo.ModTime(), fileinfo.ModTime()); err != nil {
+	if err := p.setTimes(pathname, p.accessTime(pathname, fileinfo), fileinfo.ModTime()); err != nil {
 		return err
 	}
 	return nil
 }
+
+// chown restores the recorded ownership of pathname, as translated by
+// the owner mapper.  It's a no-op unless we're running as root.
+func (p *FSExporter) chown(pathname string, fileinfo objects.FileInfo) error {
+	if os.Geteuid() != 0 {
+		return nil
+	}
+	uid, gid := p.owners.owner(fileinfo)
+	return os.Lchown(pathname, uid, gid)
+}
@@ -0,0 +1,249 @@
+/*
+ * Copyright (c) 2023 Gilles Chehade <gilles@poolp.org>
+ *
+ * Permission to use, copy, modify, and distribute this software for any
+ * purpose with or without fee is hereby granted, provided that the above
+ * copyright notice and this permission notice appear in all copies.
+ *
+ * THE SOFTWARE IS PROVIDED "AS IS" AND THE AUTHOR DISCLAIMS ALL WARRANTIES
+ * WITH REGARD TO THIS SOFTWARE INCLUDING ALL IMPLIED WARRANTIES OF
+ * MERCHANTABILITY AND FITNESS. IN NO EVENT SHALL THE AUTHOR BE LIABLE FOR
+ * ANY SPECIAL, DIRECT, INDIRECT, OR CONSEQUENTIAL DAMAGES OR ANY DAMAGES
+ * WHATSOEVER RESULTING FROM LOSS OF USE, DATA OR PROFITS, WHETHER IN AN
+ * ACTION OF CONTRACT, NEGLIGENCE OR OTHER TORTIOUS ACTION, ARISING OUT OF
+ * OR IN CONNECTION WITH THE USE OR PERFORMANCE OF THIS SOFTWARE.
+ */
+
+package exporter
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+
+	"github.com/PlakarKorp/integration-fs/storage"
+	"github.com/PlakarKorp/kloset/connectors"
+	"github.com/PlakarKorp/kloset/objects"
+)
+
+// journalDir is the directory, relative to the restore root, holding
+// the progress journal of a restore.  It's removed once the restore
+// completes successfully.
+const journalDir = ".plakar-restore"
+
+// journalFlushInterval bounds how long completed entries may sit in
+// the journal buffer, and thus how much progress a crash can lose.
+const journalFlushInterval = time.Second
+
+const (
+	journalFile      = "file"
+	journalDirectory = "dir"
+)
+
+type journalEntry struct {
+	Op       string            `json:"op"`
+	Path     string            `json:"path"`
+	Size     int64             `json:"size,omitempty"`
+	Mtime    int64             `json:"mtime,omitempty"`
+	FileInfo *objects.FileInfo `json:"fileinfo,omitempty"`
+}
+
+// journalStamp is what a completed file was restored from, so that it
+// isn't mistaken for the same path of another snapshot.
+type journalStamp struct {
+	size  int64
+	mtime int64
+}
+
+// journal records the completed records and the directories whose
+// permissions are still to be patched, so that an interrupted restore
+// can be resumed.  Nothing is journaled unless resuming is enabled.
+type journal struct {
+	enabled bool
+	root    string
+	dir     string
+
+	mu      sync.Mutex
+	fp      *os.File
+	wr      *bufio.Writer
+	enc     *json.Encoder
+	err     error
+	flushed time.Time
+
+	done map[string]journalStamp
+	dirs []dirPerm
+}
+
+func newJournal(root string, enabled bool) *journal {
+	return &journal{
+		enabled: enabled,
+		root:    root,
+		dir:     filepath.Join(root, journalDir),
+		done:    make(map[string]journalStamp),
+	}
+}
+
+// load reads back the journal left by a previous run.  Truncated or
+// malformed lines, as left by a crash, are ignored.
+func (j *journal) load() error {
+	if !j.enabled {
+		return nil
+	}
+
+	fp, err := os.Open(filepath.Join(j.dir, "journal"))
+	if err != nil {
+		if errors.Is(err, fs.ErrNotExist) {
+			return nil
+		}
+		return err
+	}
+	defer fp.Close()
+
+	scanner := bufio.NewScanner(fp)
+	scanner.Buffer(make([]byte, 0, 64*1024), 1024*1024)
+	for scanner.Scan() {
+		var entry journalEntry
+		if err := json.Unmarshal(scanner.Bytes(), &entry); err != nil {
+			continue
+		}
+
+		switch entry.Op {
+		case journalFile:
+			j.done[entry.Path] = journalStamp{size: entry.Size, mtime: entry.Mtime}
+		case journalDirectory:
+			if entry.FileInfo != nil {
+				j.dirs = append(j.dirs, dirPerm{
+					Pathname: filepath.Join(j.root, entry.Path),
+					Fileinfo: *entry.FileInfo,
+				})
+			}
+		}
+	}
+	return scanner.Err()
+}
+
+// completed tells whether path was restored from fileinfo by a
+// previous run.
+func (j *journal) completed(path string, fileinfo objects.FileInfo) bool {
+	stamp, ok := j.done[path]
+	return ok && stamp.size == fileinfo.Size() && stamp.mtime == fileinfo.ModTime().UnixNano()
+}
+
+func (j *journal) file(path string, fileinfo objects.FileInfo) {
+	j.append(journalEntry{
+		Op:    journalFile,
+		Path:  path,
+		Size:  fileinfo.Size(),
+		Mtime: fileinfo.ModTime().UnixNano(),
+	})
+}
+
+func (j *journal) directory(path string, fileinfo objects.FileInfo) {
+	j.append(journalEntry{Op: journalDirectory, Path: path, FileInfo: &fileinfo})
+}
+
+// append writes an entry to the journal, which is created on first
+// use since the restore root may not exist before.  The journal is
+// best effort: failing to write it doesn't fail the restore.
+func (j *journal) append(entry journalEntry) {
+	if !j.enabled {
+		return
+	}
+
+	j.mu.Lock()
+	defer j.mu.Unlock()
+
+	if j.err != nil {
+		return
+	}
+
+	if j.fp == nil {
+		if j.err = os.MkdirAll(j.dir, 0700); j.err != nil {
+			return
+		}
+		flags := os.O_CREATE | os.O_WRONLY | os.O_APPEND
+		if len(j.done) == 0 && len(j.dirs) == 0 {
+			flags |= os.O_TRUNC
+		}
+		j.fp, j.err = os.OpenFile(filepath.Join(j.dir, "journal"), flags, 0600)
+		if j.err != nil {
+			return
+		}
+		j.wr = bufio.NewWriter(j.fp)
+		j.enc = json.NewEncoder(j.wr)
+		j.flushed = time.Now()
+	}
+
+	if j.err = j.enc.Encode(entry); j.err != nil {
+		return
+	}
+	if time.Since(j.flushed) >= journalFlushInterval {
+		j.err = j.wr.Flush()
+		j.flushed = time.Now()
+	}
+}
+
+func (j *journal) close() error {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+
+	if j.fp == nil {
+		return nil
+	}
+
+	err := j.wr.Flush()
+	if cerr := j.fp.Close(); err == nil {
+		err = cerr
+	}
+	j.fp = nil
+	return err
+}
+
+// remove discards the journal of a completed restore.
+func (j *journal) remove() error {
+	if !j.enabled {
+		return nil
+	}
+	if err := j.close(); err != nil {
+		return err
+	}
+	return os.RemoveAll(j.dir)
+}
+
+// journalFile journals a file restored to target.  With durability
+// set, the entry is only written once the file has been renamed into
+// place durably, so that a crash can't leave it journaled but missing.
+func (p *FSExporter) journalFile(record *connectors.Record, target string) {
+	if !p.journal.enabled {
+		return
+	}
+	if p.durability >= storage.DurabilityFile {
+		if err := storage.SyncDir(filepath.Dir(target)); err != nil {
+			return
+		}
+	}
+	p.journal.file(record.Pathname, record.FileInfo)
+}
+
+// resumed tells whether record was restored to pathname by a previous
+// run and is still as it left it: a crash may have left the file
+// truncated, or without its final metadata.
+func (p *FSExporter) resumed(record *connectors.Record, pathname string) bool {
+	fileinfo := record.FileInfo
+	if !p.journal.completed(record.Pathname, fileinfo) {
+		return false
+	}
+	st, err := os.Lstat(pathname)
+	if err != nil || st.Mode().Type() != fileinfo.Mode().Type() {
+		return false
+	}
+	if st.Mode().IsRegular() && st.Size() != fileinfo.Size() {
+		return false
+	}
+	return st.ModTime().Sub(fileinfo.ModTime()).Abs() < p.timeTolerance(filepath.Dir(pathname))
+}
@@ -8,11 +8,15 @@ import (
 	"golang.org/x/sys/unix"
 )
 
+// timeResolution is the finest time that Lutimes can set.
+const timeResolution = time.Nanosecond
+
 // Lutimes sets the access and modification times of the named file.
 // If the file is a symlink, it changes the times of the symlink, not the target.
 func Lutimes(path string, atime time.Time, mtime time.Time) error {
-	var utimes [2]unix.Timeval
-	utimes[0] = unix.NsecToTimeval(atime.UnixNano())
-	utimes[1] = unix.NsecToTimeval(mtime.UnixNano())
-	return unix.Lutimes(path, utimes[0:])
+	utimes := []unix.Timespec{
+		unix.NsecToTimespec(atime.UnixNano()),
+		unix.NsecToTimespec(mtime.UnixNano()),
+	}
+	return unix.UtimesNanoAt(unix.AT_FDCWD, path, utimes, unix.AT_SYMLINK_NOFOLLOW)
 }
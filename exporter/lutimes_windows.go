@@ -8,6 +8,10 @@ import (
 	"golang.org/x/sys/windows"
 )
 
+// timeResolution is the finest time that Lutimes can set: the
+// FILETIME unit.
+const timeResolution = 100 * time.Nanosecond
+
 func Lutimes(path string, atime time.Time, mtime time.Time) error {
 	handle, err := windows.Open(path, windows.O_RDWR, 0)
 	if err != nil {
@@ -0,0 +1,178 @@
+/*
+ * Copyright (c) 2023 Gilles Chehade <gilles@poolp.org>
+ *
+ * Permission to use, copy, modify, and distribute this software for any
+ * purpose with or without fee is hereby granted, provided that the above
+ * copyright notice and this permission notice appear in all copies.
+ *
+ * THE SOFTWARE IS PROVIDED "AS IS" AND THE AUTHOR DISCLAIMS ALL WARRANTIES
+ * WITH REGARD TO THIS SOFTWARE INCLUDING ALL IMPLIED WARRANTIES OF
+ * MERCHANTABILITY AND FITNESS. IN NO EVENT SHALL THE AUTHOR BE LIABLE FOR
+ * ANY SPECIAL, DIRECT, INDIRECT, OR CONSEQUENTIAL DAMAGES OR ANY DAMAGES
+ * WHATSOEVER RESULTING FROM LOSS OF USE, DATA OR PROFITS, WHETHER IN AN
+ * ACTION OF CONTRACT, NEGLIGENCE OR OTHER TORTIOUS ACTION, ARISING OUT OF
+ * OR IN CONNECTION WITH THE USE OR PERFORMANCE OF THIS SOFTWARE.
+ */
+
+package exporter
+
+import (
+	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// mirror keeps track of the restored paths so that, once the restore
+// is complete, entries of the restore root that are not part of the
+// snapshot can be removed.
+type mirror struct {
+	enabled    bool
+	dryRun     bool
+	maxDelete  int     // 0 means no limit
+	maxPercent float64 // 0 means no limit
+
+	mu     sync.Mutex
+	seen   map[string]struct{}
+	failed map[string]struct{} // entries the snapshot couldn't read
+}
+
+func newMirror(config map[string]string) (*mirror, error) {
+	m := &mirror{
+		maxPercent: 50,
+		seen:       make(map[string]struct{}),
+		failed:     make(map[string]struct{}),
+	}
+
+	var err error
+	if v, ok := config["mirror"]; ok {
+		if m.enabled, err = strconv.ParseBool(v); err != nil {
+			return nil, fmt.Errorf("invalid mirror: %w", err)
+		}
+	}
+	if v, ok := config["mirror_dry_run"]; ok {
+		if m.dryRun, err = strconv.ParseBool(v); err != nil {
+			return nil, fmt.Errorf("invalid mirror_dry_run: %w", err)
+		}
+	}
+	if v, ok := config["mirror_max_delete"]; ok {
+		if m.maxDelete, err = strconv.Atoi(v); err != nil || m.maxDelete < 0 {
+			return nil, fmt.Errorf("invalid mirror_max_delete %q", v)
+		}
+	}
+	if v, ok := config["mirror_max_delete_percent"]; ok {
+		m.maxPercent, err = strconv.ParseFloat(v, 64)
+		if err != nil || m.maxPercent < 0 || m.maxPercent > 100 {
+			return nil, fmt.Errorf("invalid mirror_max_delete_percent %q", v)
+		}
+	}
+
+	return m, nil
+}
+
+func (m *mirror) keep(pathname string) {
+	if !m.enabled {
+		return
+	}
+	m.mu.Lock()
+	m.seen[pathname] = struct{}{}
+	m.mu.Unlock()
+}
+
+// keepFailed protects pathname and, if it's a directory, everything
+// below it: an entry that failed to be backed up is not known to be
+// stale.
+func (m *mirror) keepFailed(pathname string) {
+	if !m.enabled {
+		return
+	}
+	m.mu.Lock()
+	m.failed[pathname] = struct{}{}
+	m.mu.Unlock()
+}
+
+// prune removes from root every entry that wasn't kept.  Nothing is
+// removed if doing so would exceed the configured limits, which count
+// the content of stale directories too.
+func (p *FSExporter) prune() error {
+	m := p.mirror
+	if !m.enabled {
+		return nil
+	}
+
+	var stale []string
+	var removed, kept int
+	var staleDir string // prefix of the stale directory being walked
+	err := filepath.WalkDir(p.rootDir, func(path string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		if path == p.rootDir {
+			return nil
+		}
+		if staleDir != "" && strings.HasPrefix(path, staleDir) {
+			removed++
+			return nil
+		}
+		staleDir = ""
+		if path == p.journal.dir {
+			return filepath.SkipDir
+		}
+		if _, ok := m.failed[path]; ok {
+			kept++
+			if d.IsDir() {
+				return filepath.SkipDir
+			}
+			return nil
+		}
+		if _, ok := m.seen[path]; ok {
+			kept++
+			return nil
+		}
+		stale = append(stale, path)
+		removed++
+		if d.IsDir() {
+			staleDir = path + string(filepath.Separator)
+		}
+		return nil
+	})
+	if err != nil {
+		return fmt.Errorf("mirror: %w", err)
+	}
+
+	for _, path := range stale {
+		if m.dryRun {
+			p.logf("mirror: would remove %s\n", path)
+		}
+	}
+
+	if m.maxDelete != 0 && removed > m.maxDelete {
+		return fmt.Errorf("mirror: refusing to remove %d entries, limit is %d", removed, m.maxDelete)
+	}
+	if total := removed + kept; m.maxPercent != 0 && total != 0 {
+		if percent := float64(removed) * 100 / float64(total); percent > m.maxPercent {
+			return fmt.Errorf("mirror: refusing to remove %.1f%% of the entries, limit is %.1f%%", percent, m.maxPercent)
+		}
+	}
+
+	if m.dryRun {
+		return nil
+	}
+
+	for _, path := range stale {
+		if err := os.RemoveAll(path); err != nil {
+			return fmt.Errorf("mirror: %w", err)
+		}
+		p.logf("mirror: removed %s\n", path)
+	}
+	return nil
+}
+
+func (p *FSExporter) logf(format string, args ...any) {
+	if p.opts.Stdout != nil {
+		fmt.Fprintf(p.opts.Stdout, format, args...)
+	}
+}
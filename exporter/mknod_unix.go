@@ -0,0 +1,51 @@
+//go:build !windows
+
+package exporter
+
+import (
+	"fmt"
+	"os"
+
+	"github.com/PlakarKorp/integration-fs/internal/wire"
+	"github.com/PlakarKorp/kloset/objects"
+	"golang.org/x/sys/unix"
+)
+
+// Mknod creates the named pipe, device node or socket described by
+// fileinfo.  Device numbers are carried in fileinfo.Lsize; snapshots
+// taken before the importer recorded them have no device number, and
+// their device nodes are skipped rather than created as 0:0.
+func Mknod(path string, fileinfo objects.FileInfo) error {
+	mode := fileinfo.Mode()
+	perm := uint32(mode.Perm())
+
+	switch {
+	case mode&os.ModeNamedPipe != 0:
+		return unix.Mkfifo(path, perm)
+
+	case mode&os.ModeSocket != 0:
+		return mknod(unix.Mknod, path, unix.S_IFSOCK|perm, 0)
+
+	case mode&os.ModeDevice != 0:
+		if os.Geteuid() != 0 {
+			return fmt.Errorf("%w: restoring devices requires root privileges", errSkipped)
+		}
+		if fileinfo.Lsize == 0 {
+			return fmt.Errorf("%w: no device number recorded", errSkipped)
+		}
+		kind := uint32(unix.S_IFBLK)
+		if mode&os.ModeCharDevice != 0 {
+			kind = unix.S_IFCHR
+		}
+		major, minor := wire.DecodeDev(fileinfo.Lsize)
+		return mknod(unix.Mknod, path, kind|perm, unix.Mkdev(major, minor))
+	}
+
+	return fmt.Errorf("unsupported file type %s", mode.Type())
+}
+
+// mknod papers over unix.Mknod taking the device as an int on most
+// systems but as an uint64 on FreeBSD.
+func mknod[T int | uint64](fn func(string, uint32, T) error, path string, mode uint32, dev uint64) error {
+	return fn(path, mode, T(dev))
+}
@@ -0,0 +1,13 @@
+//go:build windows
+
+package exporter
+
+import (
+	"fmt"
+
+	"github.com/PlakarKorp/kloset/objects"
+)
+
+func Mknod(path string, fileinfo objects.FileInfo) error {
+	return fmt.Errorf("unsupported file type %s", fileinfo.Mode().Type())
+}
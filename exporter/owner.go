@@ -0,0 +1,189 @@
+/*
+ * Copyright (c) 2023 Gilles Chehade <gilles@poolp.org>
+ *
+ * Permission to use, copy, modify, and distribute this software for any
+ * purpose with or without fee is hereby granted, provided that the above
+ * copyright notice and this permission notice appear in all copies.
+ *
+ * THE SOFTWARE IS PROVIDED "AS IS" AND THE AUTHOR DISCLAIMS ALL WARRANTIES
+ * WITH REGARD TO THIS SOFTWARE INCLUDING ALL IMPLIED WARRANTIES OF
+ * MERCHANTABILITY AND FITNESS. IN NO EVENT SHALL THE AUTHOR BE LIABLE FOR
+ * ANY SPECIAL, DIRECT, INDIRECT, OR CONSEQUENTIAL DAMAGES OR ANY DAMAGES
+ * WHATSOEVER RESULTING FROM LOSS OF USE, DATA OR PROFITS, WHETHER IN AN
+ * ACTION OF CONTRACT, NEGLIGENCE OR OTHER TORTIOUS ACTION, ARISING OUT OF
+ * OR IN CONNECTION WITH THE USE OR PERFORMANCE OF THIS SOFTWARE.
+ */
+
+package exporter
+
+import (
+	"fmt"
+	"os/user"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/PlakarKorp/kloset/objects"
+)
+
+// ownerMapper translates the ownership recorded in a snapshot into
+// the uid and gid to use on the restore host.
+type ownerMapper struct {
+	byName bool
+
+	uids   map[uint64]uint64
+	gids   map[uint64]uint64
+	users  map[string]string
+	groups map[string]string
+
+	mu        sync.Mutex
+	userToID  map[string]int // -1 if the name doesn't resolve
+	groupToID map[string]int
+}
+
+func newOwnerMapper(config map[string]string) (*ownerMapper, error) {
+	m := &ownerMapper{
+		userToID:  make(map[string]int),
+		groupToID: make(map[string]int),
+	}
+
+	switch config["ownership"] {
+	case "", "numeric":
+	case "name":
+		m.byName = true
+	default:
+		return nil, fmt.Errorf("invalid ownership mode %q", config["ownership"])
+	}
+
+	var err error
+	if m.uids, err = parseIDMap(config["uid_map"]); err != nil {
+		return nil, fmt.Errorf("invalid uid_map: %w", err)
+	}
+	if m.gids, err = parseIDMap(config["gid_map"]); err != nil {
+		return nil, fmt.Errorf("invalid gid_map: %w", err)
+	}
+	if m.users, err = parseNameMap(config["user_map"]); err != nil {
+		return nil, fmt.Errorf("invalid user_map: %w", err)
+	}
+	if m.groups, err = parseNameMap(config["group_map"]); err != nil {
+		return nil, fmt.Errorf("invalid group_map: %w", err)
+	}
+
+	return m, nil
+}
+
+// parseMapping splits a comma-separated list of "from:to" pairs.
+func parseMapping(s string, fn func(from, to string) error) error {
+	for _, pair := range strings.Split(s, ",") {
+		pair = strings.TrimSpace(pair)
+		if pair == "" {
+			continue
+		}
+		from, to, found := strings.Cut(pair, ":")
+		if !found || from == "" || to == "" {
+			return fmt.Errorf("malformed entry %q", pair)
+		}
+		if err := fn(from, to); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func parseIDMap(s string) (map[uint64]uint64, error) {
+	ret := make(map[uint64]uint64)
+	err := parseMapping(s, func(from, to string) error {
+		f, err := strconv.ParseUint(from, 10, 32)
+		if err != nil {
+			return err
+		}
+		t, err := strconv.ParseUint(to, 10, 32)
+		if err != nil {
+			return err
+		}
+		ret[f] = t
+		return nil
+	})
+	return ret, err
+}
+
+func parseNameMap(s string) (map[string]string, error) {
+	ret := make(map[string]string)
+	err := parseMapping(s, func(from, to string) error {
+		ret[from] = to
+		return nil
+	})
+	return ret, err
+}
+
+// owner returns the uid and gid that pathnames recorded with
+// fileinfo should be given.  Names are resolved on this host when
+// running by name or when a name mapping matches, falling back to the
+// numeric ids (subject to uid_map and gid_map) otherwise.
+func (m *ownerMapper) owner(fileinfo objects.FileInfo) (uid, gid int) {
+	uid = m.resolve(fileinfo.Username(), m.users, m.userToID, lookupUser)
+	if uid == -1 {
+		uid = int(remapID(fileinfo.Uid(), m.uids))
+	}
+
+	gid = m.resolve(fileinfo.Groupname(), m.groups, m.groupToID, lookupGroup)
+	if gid == -1 {
+		gid = int(remapID(fileinfo.Gid(), m.gids))
+	}
+
+	return uid, gid
+}
+
+func (m *ownerMapper) resolve(name string, names map[string]string, cache map[string]int, lookup func(string) int) int {
+	if name == "" {
+		return -1
+	}
+
+	mapped, ok := names[name]
+	if ok {
+		name = mapped
+	} else if !m.byName {
+		return -1
+	}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	id, ok := cache[name]
+	if !ok {
+		id = lookup(name)
+		cache[name] = id
+	}
+	return id
+}
+
+func remapID(id uint64, ids map[uint64]uint64) uint64 {
+	if mapped, ok := ids[id]; ok {
+		return mapped
+	}
+	return id
+}
+
+func lookupUser(name string) int {
+	u, err := user.Lookup(name)
+	if err != nil {
+		return -1
+	}
+	id, err := strconv.Atoi(u.Uid)
+	if err != nil {
+		return -1
+	}
+	return id
+}
+
+func lookupGroup(name string) int {
+	g, err := user.LookupGroup(name)
+	if err != nil {
+		return -1
+	}
+	id, err := strconv.Atoi(g.Gid)
+	if err != nil {
+		return -1
+	}
+	return id
+}
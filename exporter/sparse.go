@@ -0,0 +1,91 @@
+/*
+ * Copyright (c) 2023 Gilles Chehade <gilles@poolp.org>
+ *
+ * Permission to use, copy, modify, and distribute this software for any
+ * purpose with or without fee is hereby granted, provided that the above
+ * copyright notice and this permission notice appear in all copies.
+ *
+ * THE SOFTWARE IS PROVIDED "AS IS" AND THE AUTHOR DISCLAIMS ALL WARRANTIES
+ * WITH REGARD TO THIS SOFTWARE INCLUDING ALL IMPLIED WARRANTIES OF
+ * MERCHANTABILITY AND FITNESS. IN NO EVENT SHALL THE AUTHOR BE LIABLE FOR
+ * ANY SPECIAL, DIRECT, INDIRECT, OR CONSEQUENTIAL DAMAGES OR ANY DAMAGES
+ * WHATSOEVER RESULTING FROM LOSS OF USE, DATA OR PROFITS, WHETHER IN AN
+ * ACTION OF CONTRACT, NEGLIGENCE OR OTHER TORTIOUS ACTION, ARISING OUT OF
+ * OR IN CONNECTION WITH THE USE OR PERFORMANCE OF THIS SOFTWARE.
+ */
+
+package exporter
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"os"
+
+	"github.com/PlakarKorp/integration-fs/internal/wire"
+	"github.com/PlakarKorp/kloset/objects"
+)
+
+// sparseBlock is the granularity at which zero runs become holes.
+const sparseBlock = 4096
+
+type sparseMode int
+
+const (
+	sparseAuto   sparseMode = iota // only files recorded as sparse
+	sparseAlways                   // every regular file
+	sparseNever
+)
+
+func parseSparseMode(s string) (sparseMode, error) {
+	switch s {
+	case "", "auto":
+		return sparseAuto, nil
+	case "always":
+		return sparseAlways, nil
+	case "never":
+		return sparseNever, nil
+	}
+	return 0, fmt.Errorf("invalid sparse mode %q", s)
+}
+
+func (p *FSExporter) isSparse(fileinfo objects.FileInfo) bool {
+	switch p.sparse {
+	case sparseAlways:
+		return true
+	case sparseAuto:
+		return fileinfo.Flags&wire.FlagSparse != 0
+	}
+	return false
+}
+
+// copySparse copies rd to fp, skipping over the blocks that are all
+// zeroes so that they end up as holes.
+func copySparse(fp *os.File, rd io.Reader) (int64, error) {
+	var zeroes [sparseBlock]byte
+	buf := make([]byte, 32*sparseBlock)
+
+	var offset int64
+	for {
+		n, err := io.ReadFull(rd, buf)
+		for i := 0; i < n; i += sparseBlock {
+			block := buf[i:min(i+sparseBlock, n)]
+			if !bytes.Equal(block, zeroes[:len(block)]) {
+				if _, err := fp.WriteAt(block, offset); err != nil {
+					return offset, err
+				}
+			}
+			offset += int64(len(block))
+		}
+
+		if err == io.EOF || err == io.ErrUnexpectedEOF {
+			break
+		}
+		if err != nil {
+			return offset, err
+		}
+	}
+
+	// A trailing hole isn't materialized by the writes.
+	return offset, fp.Truncate(offset)
+}
@@ -0,0 +1,93 @@
+/*
+ * Copyright (c) 2023 Gilles Chehade <gilles@poolp.org>
+ *
+ * Permission to use, copy, modify, and distribute this software for any
+ * purpose with or without fee is hereby granted, provided that the above
+ * copyright notice and this permission notice appear in all copies.
+ *
+ * THE SOFTWARE IS PROVIDED "AS IS" AND THE AUTHOR DISCLAIMS ALL WARRANTIES
+ * WITH REGARD TO THIS SOFTWARE INCLUDING ALL IMPLIED WARRANTIES OF
+ * MERCHANTABILITY AND FITNESS. IN NO EVENT SHALL THE AUTHOR BE LIABLE FOR
+ * ANY SPECIAL, DIRECT, INDIRECT, OR CONSEQUENTIAL DAMAGES OR ANY DAMAGES
+ * WHATSOEVER RESULTING FROM LOSS OF USE, DATA OR PROFITS, WHETHER IN AN
+ * ACTION OF CONTRACT, NEGLIGENCE OR OTHER TORTIOUS ACTION, ARISING OUT OF
+ * OR IN CONNECTION WITH THE USE OR PERFORMANCE OF THIS SOFTWARE.
+ */
+
+package exporter
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"time"
+
+	"github.com/PlakarKorp/integration-fs/internal/wire"
+	"github.com/PlakarKorp/kloset/objects"
+)
+
+// hasTimes tells whether a times record follows the record of a path.
+func hasTimes(fileinfo objects.FileInfo) bool {
+	return fileinfo.Flags&wire.FlagTimes != 0
+}
+
+// applyTimes restores the access time recorded in a times record.
+func (p *FSExporter) applyTimes(pathname string, value []byte) error {
+	var t wire.Times
+	if err := json.Unmarshal(value, &t); err != nil {
+		return fmt.Errorf("invalid times record: %w", err)
+	}
+	if t.Atime == 0 {
+		return nil
+	}
+
+	atime := time.Unix(0, t.Atime)
+	mtime := time.Unix(0, t.Mtime)
+
+	// directories get their times set again once their content has
+	// been restored
+	if info, err := os.Lstat(pathname); err == nil && info.IsDir() {
+		p.atimeMu.Lock()
+		p.atimes[pathname] = atime
+		p.atimeMu.Unlock()
+	}
+
+	return p.setTimes(pathname, atime, mtime)
+}
+
+// accessTime returns the access time to give pathname: the recorded
+// one if known, its modification time otherwise.
+func (p *FSExporter) accessTime(pathname string, fileinfo objects.FileInfo) time.Time {
+	p.atimeMu.Lock()
+	defer p.atimeMu.Unlock()
+
+	if atime, ok := p.atimes[pathname]; ok {
+		return atime
+	}
+	return fileinfo.ModTime()
+}
+
+// setTimes sets the access and modification times of pathname and,
+// with verify_times, makes sure that the filesystem kept them.
+func (p *FSExporter) setTimes(pathname string, atime, mtime time.Time) error {
+	if err := Lutimes(pathname, atime, mtime); err != nil {
+		return err
+	}
+	if !p.verifyTimes {
+		return nil
+	}
+
+	st, err := os.Lstat(pathname)
+	if err != nil {
+		return err
+	}
+	if st.ModTime().Sub(mtime).Abs() >= timeResolution {
+		return fmt.Errorf("%s: modification time is %s instead of %s",
+			pathname, st.ModTime().Format(time.RFC3339Nano), mtime.Format(time.RFC3339Nano))
+	}
+	if got, ok := statAtime(st); ok && got.Sub(atime).Abs() >= timeResolution {
+		return fmt.Errorf("%s: access time is %s instead of %s",
+			pathname, got.Format(time.RFC3339Nano), atime.Format(time.RFC3339Nano))
+	}
+	return nil
+}
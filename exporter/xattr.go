@@ -0,0 +1,189 @@
+/*
+ * Copyright (c) 2023 Gilles Chehade <gilles@poolp.org>
+ *
+ * Permission to use, copy, modify, and distribute this software for any
+ * purpose with or without fee is hereby granted, provided that the above
+ * copyright notice and this permission notice appear in all copies.
+ *
+ * THE SOFTWARE IS PROVIDED "AS IS" AND THE AUTHOR DISCLAIMS ALL WARRANTIES
+ * WITH REGARD TO THIS SOFTWARE INCLUDING ALL IMPLIED WARRANTIES OF
+ * MERCHANTABILITY AND FITNESS. IN NO EVENT SHALL THE AUTHOR BE LIABLE FOR
+ * ANY SPECIAL, DIRECT, INDIRECT, OR CONSEQUENTIAL DAMAGES OR ANY DAMAGES
+ * WHATSOEVER RESULTING FROM LOSS OF USE, DATA OR PROFITS, WHETHER IN AN
+ * ACTION OF CONTRACT, NEGLIGENCE OR OTHER TORTIOUS ACTION, ARISING OUT OF
+ * OR IN CONNECTION WITH THE USE OR PERFORMANCE OF THIS SOFTWARE.
+ */
+
+package exporter
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+
+	"github.com/PlakarKorp/integration-fs/internal/wire"
+	"github.com/PlakarKorp/kloset/connectors"
+	"github.com/PlakarKorp/kloset/objects"
+	"github.com/pkg/xattr"
+)
+
+// pendingXattr is an extended attribute whose value has been read
+// but that can't be applied yet because its target doesn't exist.
+type pendingXattr struct {
+	record *connectors.Record
+	value  []byte
+}
+
+// xattrState tracks the extended attributes and times record of a
+// single restored path.  Records for a path and for its attributes may
+// arrive in any order, so attributes are parked until the path has
+// been created.
+type xattrState struct {
+	created   bool
+	target    string // where the path was restored, empty if skipped
+	remaining int    // announced attributes not received yet
+	pending   []pendingXattr
+}
+
+// xattrSending records that the caller sends attribute records.  Not
+// every caller does: paths restored before that is known don't wait
+// for their attributes, and those that come later are reported as
+// having no target.
+func (p *FSExporter) xattrSending() {
+	p.xattrMu.Lock()
+	p.xattrSeen = true
+	p.xattrMu.Unlock()
+}
+
+// xattrRecord handles an extended attribute or times record: it's
+// applied right away if its target has already been restored, queued
+// otherwise.
+func (p *FSExporter) xattrRecord(record *connectors.Record, pathname string, results chan<- *connectors.Result) {
+	if record.XattrType != objects.AttributeExtended && record.XattrType != wire.AttributeTimes {
+		results <- record.Error(fmt.Errorf("unsupported attribute type %d for %q", record.XattrType, record.XattrName))
+		return
+	}
+
+	value, err := io.ReadAll(record.Reader)
+	if err != nil {
+		results <- record.Error(err)
+		return
+	}
+
+	p.xattrMu.Lock()
+	st, ok := p.xattrs[pathname]
+	if !ok {
+		st = &xattrState{}
+		p.xattrs[pathname] = st
+	}
+	if !st.created {
+		st.pending = append(st.pending, pendingXattr{record: record, value: value})
+		p.xattrMu.Unlock()
+		return
+	}
+	st.remaining--
+	if st.remaining <= 0 {
+		delete(p.xattrs, pathname)
+	}
+	target := st.target
+	p.xattrMu.Unlock()
+
+	p.applyXattr(target, pendingXattr{record: record, value: value}, results)
+}
+
+// xattrCreated marks pathname as restored to target and applies the
+// attributes that were received before it.  An empty target means
+// that the path was skipped, and so are its attributes.
+func (p *FSExporter) xattrCreated(record *connectors.Record, pathname, target string, results chan<- *connectors.Result) {
+	p.xattrMu.Lock()
+	st, ok := p.xattrs[pathname]
+	if !ok {
+		if !p.xattrSeen || len(record.ExtendedAttributes) == 0 && !hasTimes(record.FileInfo) {
+			p.xattrMu.Unlock()
+			return
+		}
+		st = &xattrState{}
+		p.xattrs[pathname] = st
+	}
+
+	pending := st.pending
+	st.pending = nil
+	st.created = true
+	st.target = target
+	st.remaining = len(record.ExtendedAttributes) - len(pending)
+	if hasTimes(record.FileInfo) {
+		st.remaining++
+	}
+	if st.remaining <= 0 {
+		delete(p.xattrs, pathname)
+	}
+	p.xattrMu.Unlock()
+
+	for _, px := range pending {
+		p.applyXattr(target, px, results)
+	}
+}
+
+// xattrFlush reports the attributes whose target was never restored.
+// Those announced by a restored target but never received aren't
+// errors: the caller may not send attribute records at all.
+func (p *FSExporter) xattrFlush(results chan<- *connectors.Result) {
+	p.xattrMu.Lock()
+	defer p.xattrMu.Unlock()
+
+	for pathname, st := range p.xattrs {
+		for _, px := range st.pending {
+			results <- px.record.Error(fmt.Errorf("target %q was not restored", pathname))
+		}
+		delete(p.xattrs, pathname)
+	}
+}
+
+func (p *FSExporter) applyXattr(pathname string, px pendingXattr, results chan<- *connectors.Result) {
+	if pathname == "" {
+		results <- px.record.Error(fmt.Errorf("%w: attribute target was skipped", errSkipped))
+		return
+	}
+	var err error
+	if px.record.XattrType == wire.AttributeTimes {
+		err = p.applyTimes(pathname, px.value)
+	} else {
+		err = p.setXattr(pathname, px.record.XattrName, px.value)
+	}
+	if err != nil {
+		results <- px.record.Error(err)
+		return
+	}
+	results <- px.record.Ok()
+}
+
+// setXattr sets an extended attribute on pathname.  Attributes may
+// arrive after the path got its final, possibly read-only, mode: when
+// the owner lacks the write permission needed to set them, it's
+// granted for the time of the call.
+func (p *FSExporter) setXattr(pathname, name string, value []byte) error {
+	err := xattr.LSet(pathname, name, value)
+	if !errors.Is(err, fs.ErrPermission) {
+		return err
+	}
+
+	p.xattrWriteMu.Lock()
+	defer p.xattrWriteMu.Unlock()
+
+	info, serr := os.Lstat(pathname)
+	if serr != nil || info.Mode()&os.ModeSymlink != 0 || info.Mode().Perm()&0200 != 0 {
+		return xattr.LSet(pathname, name, value)
+	}
+
+	mode := info.Mode().Perm() | info.Mode()&(os.ModeSetuid|os.ModeSetgid|os.ModeSticky)
+	if err := os.Chmod(pathname, mode|0200); err != nil {
+		return err
+	}
+	err = xattr.LSet(pathname, name, value)
+	if cerr := os.Chmod(pathname, mode); err == nil {
+		err = cerr
+	}
+	return err
+}
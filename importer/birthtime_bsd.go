@@ -0,0 +1,18 @@
+//go:build darwin || freebsd || netbsd
+
+package importer
+
+import (
+	"io/fs"
+	"syscall"
+)
+
+// birthTime returns the creation time of a file, when the filesystem
+// records it.
+func birthTime(path string, info fs.FileInfo) (int64, bool) {
+	sb, ok := info.Sys().(*syscall.Stat_t)
+	if !ok || sb.Birthtimespec.Sec <= 0 {
+		return 0, false
+	}
+	return sb.Birthtimespec.Nano(), true
+}
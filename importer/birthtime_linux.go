@@ -0,0 +1,26 @@
+//go:build linux
+
+package importer
+
+import (
+	"io/fs"
+
+	"golang.org/x/sys/unix"
+)
+
+// birthTime returns the creation time of a file, when the filesystem
+// records it.
+func birthTime(path string, info fs.FileInfo) (int64, bool) {
+	if si, ok := info.(*statxInfo); ok {
+		return si.btime.UnixNano(), !si.btime.IsZero()
+	}
+
+	var stx unix.Statx_t
+	if err := unix.Statx(unix.AT_FDCWD, path, unix.AT_SYMLINK_NOFOLLOW|unix.AT_NO_AUTOMOUNT, unix.STATX_BTIME, &stx); err != nil {
+		return 0, false
+	}
+	if stx.Mask&unix.STATX_BTIME == 0 {
+		return 0, false
+	}
+	return statxNsec(stx.Btime), true
+}
@@ -0,0 +1,11 @@
+//go:build !linux && !darwin && !freebsd && !netbsd
+
+package importer
+
+import (
+	"io/fs"
+)
+
+func birthTime(path string, info fs.FileInfo) (int64, bool) {
+	return 0, false
+}
@@ -0,0 +1,315 @@
+/*
+ * Copyright (c) 2023 Gilles Chehade <gilles@poolp.org>
+ *
+ * Permission to use, copy, modify, and distribute this software for any
+ * purpose with or without fee is hereby granted, provided that the above
+ * copyright notice and this permission notice appear in all copies.
+ *
+ * THE SOFTWARE IS PROVIDED "AS IS" AND THE AUTHOR DISCLAIMS ALL WARRANTIES
+ * WITH REGARD TO THIS SOFTWARE INCLUDING ALL IMPLIED WARRANTIES OF
+ * MERCHANTABILITY AND FITNESS. IN NO EVENT SHALL THE AUTHOR BE LIABLE FOR
+ * ANY SPECIAL, DIRECT, INDIRECT, OR CONSEQUENTIAL DAMAGES OR ANY DAMAGES
+ * WHATSOEVER RESULTING FROM LOSS OF USE, DATA OR PROFITS, WHETHER IN AN
+ * ACTION OF CONTRACT, NEGLIGENCE OR OTHER TORTIOUS ACTION, ARISING OUT OF
+ * OR IN CONNECTION WITH THE USE OR PERFORMANCE OF THIS SOFTWARE.
+ */
+
+package importer
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"strconv"
+	"sync"
+
+	"github.com/PlakarKorp/kloset/connectors"
+	"github.com/PlakarKorp/kloset/objects"
+)
+
+var errFileChanged = errors.New("file changed while being read")
+
+// changedFiles tells what to do with regular files modified between
+// the walk and the end of their read.
+type changedFiles struct {
+	fail       bool   // report them as failed rather than with a warning
+	retries    int    // times they're read again, when staged
+	stagingDir string // where files are staged before being read
+}
+
+func parseChangedFiles(config map[string]string) (changedFiles, error) {
+	var c changedFiles
+
+	switch config["changed_files"] {
+	case "", "warn":
+	case "error":
+		c.fail = true
+	default:
+		return c, fmt.Errorf("invalid changed_files mode %q", config["changed_files"])
+	}
+
+	if v, ok := config["changed_files_retries"]; ok {
+		n, err := strconv.Atoi(v)
+		if err != nil || n < 0 {
+			return c, fmt.Errorf("invalid changed_files_retries %q", v)
+		}
+		c.retries = n
+	}
+
+	c.stagingDir = config["changed_files_staging_dir"]
+	if c.retries > 0 && c.stagingDir == "" {
+		return c, fmt.Errorf("changed_files_retries requires changed_files_staging_dir")
+	}
+	return c, nil
+}
+
+// changeReport collects the files found changed while kloset read
+// them.  They can't be recorded from there, so they're recorded once
+// kloset acknowledged every record, which tells that every file has
+// been read.
+type changeReport struct {
+	mu      sync.Mutex
+	sent    int
+	acked   int
+	done    bool          // results were closed
+	notify  chan struct{} // an acknowledgment came
+	changed []string
+}
+
+func newChangeReport() *changeReport {
+	return &changeReport{notify: make(chan struct{}, 1)}
+}
+
+func (r *changeReport) add(origin string) {
+	r.mu.Lock()
+	r.changed = append(r.changed, origin)
+	r.mu.Unlock()
+}
+
+// forward counts and passes on the records of the walk.
+func (r *changeReport) forward(in <-chan *connectors.Record, out chan<- *connectors.Record) {
+	for record := range in {
+		r.mu.Lock()
+		r.sent++
+		r.mu.Unlock()
+		out <- record
+	}
+}
+
+// acknowledge counts the acknowledgments of the records.
+func (r *changeReport) acknowledge(results <-chan *connectors.Result) {
+	for range results {
+		r.mu.Lock()
+		r.acked++
+		r.mu.Unlock()
+		select {
+		case r.notify <- struct{}{}:
+		default:
+		}
+	}
+	r.mu.Lock()
+	r.done = true
+	r.mu.Unlock()
+	select {
+	case r.notify <- struct{}{}:
+	default:
+	}
+}
+
+// flush waits for every record sent to be acknowledged and records the
+// changed files as errors.
+func (r *changeReport) flush(ctx context.Context, records chan<- *connectors.Record) error {
+	for {
+		r.mu.Lock()
+		idle := r.done || r.acked >= r.sent
+		r.mu.Unlock()
+		if idle {
+			break
+		}
+		select {
+		case <-r.notify:
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+
+	r.mu.Lock()
+	changed := r.changed
+	r.changed = nil
+	r.sent += len(changed)
+	r.mu.Unlock()
+
+	for _, origin := range changed {
+		records <- connectors.NewError(origin, errFileChanged)
+	}
+	return nil
+}
+
+// checkedFile reads a regular file and makes sure, when opened and
+// once the whole content has been read, that it wasn't modified since
+// the walk stat'ed it: the content would otherwise not match the
+// recorded metadata, or even be a mix of two versions of the file.
+type checkedFile struct {
+	f        *FSImporter
+	origin   string
+	info     fs.FileInfo // as seen by the walk
+	fp       *os.File
+	reported bool
+}
+
+func (f *FSImporter) openChecked(p file) (io.ReadCloser, error) {
+	fp, info, err := openStat(p.path)
+	if err != nil {
+		return nil, err
+	}
+
+	c := &checkedFile{f: f, origin: p.origin, info: p.info, fp: fp}
+	if fileChanged(p.info, info) {
+		if err := c.changed(); err != nil {
+			fp.Close()
+			return nil, err
+		}
+	}
+	return c, nil
+}
+
+func openStat(path string) (*os.File, fs.FileInfo, error) {
+	fp, err := os.Open(path)
+	if err != nil {
+		return nil, nil, err
+	}
+	info, err := fp.Stat()
+	if err != nil {
+		fp.Close()
+		return nil, nil, err
+	}
+	return fp, info, nil
+}
+
+func (c *checkedFile) Read(b []byte) (int, error) {
+	n, err := c.fp.Read(b)
+	if err == io.EOF && !c.reported {
+		if cerr := c.check(); cerr != nil {
+			return n, cerr
+		}
+	}
+	return n, err
+}
+
+func (c *checkedFile) Close() error {
+	return c.fp.Close()
+}
+
+func (c *checkedFile) check() error {
+	after, err := c.fp.Stat()
+	if err != nil {
+		return err
+	}
+	if fileChanged(c.info, after) {
+		return c.changed()
+	}
+	return nil
+}
+
+// changed handles a file that changed while being read: it's an error
+// with changed_files=error, recorded as such once the backup is done
+// otherwise.
+func (c *checkedFile) changed() error {
+	c.reported = true
+	if c.f.changed.fail {
+		return fmt.Errorf("%s: %w", c.origin, errFileChanged)
+	}
+	c.f.report.add(c.origin)
+	return nil
+}
+
+// stagedFile is a copy of a file made in the staging directory, that
+// goes away once read.
+type stagedFile struct {
+	*os.File
+}
+
+func (s stagedFile) Close() error {
+	err := s.File.Close()
+	os.Remove(s.Name())
+	return err
+}
+
+// stage copies the file at p to the staging directory until a copy is
+// made without the file changing, or the retries are exhausted.  The
+// size and modification time in fileinfo are updated to those of the
+// copied content, which may be newer than the walk's.
+func (f *FSImporter) stage(p file, fileinfo *objects.FileInfo) (io.ReadCloser, error) {
+	tmp, err := os.CreateTemp(f.stagingDir, "plakar-staged-*")
+	if err != nil {
+		return nil, err
+	}
+	staged := stagedFile{tmp}
+
+	for attempt := 0; ; attempt++ {
+		info, changed, err := copyStat(tmp, p.path)
+		if err != nil {
+			staged.Close()
+			return nil, err
+		}
+		fileinfo.Lsize = info.Size()
+		fileinfo.LmodTime = info.ModTime()
+		if !changed {
+			break
+		}
+		if attempt == f.changed.retries {
+			if f.changed.fail {
+				staged.Close()
+				return nil, errFileChanged
+			}
+			f.report.add(p.origin)
+			break
+		}
+	}
+
+	if _, err := tmp.Seek(0, io.SeekStart); err != nil {
+		staged.Close()
+		return nil, err
+	}
+	return staged, nil
+}
+
+// copyStat copies the file at path to dst, and returns its stat once
+// copied and whether it changed meanwhile.
+func copyStat(dst *os.File, path string) (fs.FileInfo, bool, error) {
+	if _, err := dst.Seek(0, io.SeekStart); err != nil {
+		return nil, false, err
+	}
+	if err := dst.Truncate(0); err != nil {
+		return nil, false, err
+	}
+
+	fp, before, err := openStat(path)
+	if err != nil {
+		return nil, false, err
+	}
+	defer fp.Close()
+
+	if _, err := io.Copy(dst, fp); err != nil {
+		return nil, false, err
+	}
+	after, err := fp.Stat()
+	if err != nil {
+		return nil, false, err
+	}
+	return after, fileChanged(before, after), nil
+}
+
+// fileChanged compares the size, mtime and, where available, ctime of
+// two stats of the same file.
+func fileChanged(before, after fs.FileInfo) bool {
+	if before.Size() != after.Size() || !before.ModTime().Equal(after.ModTime()) {
+		return true
+	}
+	_, _, bctime, bok := statIdentity(before)
+	_, _, actime, aok := statIdentity(after)
+	return bok && aok && bctime != actime
+}
@@ -0,0 +1,23 @@
+//go:build !windows
+
+package importer
+
+import (
+	"io/fs"
+	"syscall"
+
+	"github.com/PlakarKorp/integration-fs/internal/wire"
+	"golang.org/x/sys/unix"
+)
+
+// deviceNumber returns the device number of a device node, encoded
+// for FileInfo.Lsize.
+func deviceNumber(info fs.FileInfo) int64 {
+	sb, ok := info.Sys().(*syscall.Stat_t)
+	if !ok {
+		return 0
+	}
+
+	rdev := uint64(sb.Rdev)
+	return wire.EncodeDev(unix.Major(rdev), unix.Minor(rdev))
+}
@@ -0,0 +1,158 @@
+/*
+ * Copyright (c) 2023 Gilles Chehade <gilles@poolp.org>
+ *
+ * Permission to use, copy, modify, and distribute this software for any
+ * purpose with or without fee is hereby granted, provided that the above
+ * copyright notice and this permission notice appear in all copies.
+ *
+ * THE SOFTWARE IS PROVIDED "AS IS" AND THE AUTHOR DISCLAIMS ALL WARRANTIES
+ * WITH REGARD TO THIS SOFTWARE INCLUDING ALL IMPLIED WARRANTIES OF
+ * MERCHANTABILITY AND FITNESS. IN NO EVENT SHALL THE AUTHOR BE LIABLE FOR
+ * ANY SPECIAL, DIRECT, INDIRECT, OR CONSEQUENTIAL DAMAGES OR ANY DAMAGES
+ * WHATSOEVER RESULTING FROM LOSS OF USE, DATA OR PROFITS, WHETHER IN AN
+ * ACTION OF CONTRACT, NEGLIGENCE OR OTHER TORTIOUS ACTION, ARISING OUT OF
+ * OR IN CONNECTION WITH THE USE OR PERFORMANCE OF THIS SOFTWARE.
+ */
+
+package importer
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+
+	"github.com/PlakarKorp/kloset/connectors"
+)
+
+// filesFrom_walker imports the paths listed in f.filesFrom, along with
+// their parent directories, instead of walking the roots.  Listed
+// directories are imported without their content.
+func (f *FSImporter) filesFrom_walker(ctx context.Context, records chan<- *connectors.Record, numWorkers int) error {
+	rd := f.opts.Stdin
+	if f.filesFrom == "-" {
+		if rd == nil {
+			return fmt.Errorf("files_from: no standard input to read from")
+		}
+	} else {
+		fp, err := os.Open(f.filesFrom)
+		if err != nil {
+			return fmt.Errorf("failed to open files_from: %w", err)
+		}
+		defer fp.Close()
+		rd = fp
+	}
+
+	jobs := make(chan file, numWorkers*4)
+	var wg sync.WaitGroup
+	for range numWorkers {
+		wg.Add(1)
+		go f.walkDir_worker(jobs, records, &wg)
+	}
+
+	sep := byte('\n')
+	if f.filesFromNul {
+		sep = 0
+	}
+
+	// relative paths are relative to location
+	base := f.location.realpath
+	if f.location.rootIsFile {
+		base = filepath.Dir(base)
+	}
+
+	seen := make(map[string]bool)
+	sc := bufio.NewScanner(rd)
+	sc.Split(func(data []byte, atEOF bool) (int, []byte, error) {
+		if i := bytes.IndexByte(data, sep); i >= 0 {
+			return i + 1, data[:i], nil
+		}
+		if atEOF && len(data) > 0 {
+			return len(data), data, nil
+		}
+		return 0, nil, nil
+	})
+
+	for sc.Scan() && ctx.Err() == nil {
+		path := sc.Text()
+		if sep == '\n' {
+			path = strings.TrimSuffix(path, "\r")
+		}
+		if path == "" {
+			continue
+		}
+		if !filepath.IsAbs(path) {
+			path = filepath.Join(base, path)
+		}
+		path = filepath.Clean(path)
+
+		if seen[path] {
+			continue
+		}
+
+		info, err := os.Lstat(path)
+		if err != nil {
+			records <- connectors.NewError(path, err)
+			continue
+		}
+		if f.listedExcluded(path, info.IsDir()) {
+			continue
+		}
+
+		walkDir_addPrefixDirectories(filepath.Dir(path), records, seen)
+		seen[path] = true
+
+		readPath := f.snapshotPath(path)
+		if readPath != path {
+			if info, err = os.Lstat(readPath); err != nil {
+				records <- connectors.NewError(path, err)
+				continue
+			}
+		}
+
+		jobs <- file{path: readPath, origin: path, info: info}
+	}
+
+	close(jobs)
+	wg.Wait()
+
+	if err := sc.Err(); err != nil {
+		return fmt.Errorf("failed to read files_from: %w", err)
+	}
+	return nil
+}
+
+// snapshotPath returns where path is read from: within the snapshot
+// of the root holding it, if any.
+func (f *FSImporter) snapshotPath(path string) string {
+	for _, r := range f.roots {
+		if r.snapRoot == "" {
+			continue
+		}
+		rel, err := filepath.Rel(r.realpath, path)
+		if err != nil || rel == ".." || strings.HasPrefix(rel, ".."+string(filepath.Separator)) {
+			continue
+		}
+		return filepath.Join(r.snapRoot, rel)
+	}
+	return path
+}
+
+// listedExcluded tells whether path, or any of its parents, matches
+// the exclude rules.  Parents matter here as nothing walks them.
+func (f *FSImporter) listedExcluded(path string, isDir bool) bool {
+	for {
+		if path == filepath.Dir(path) {
+			return false
+		}
+		if f.excludes.IsExcluded(path, isDir) {
+			return true
+		}
+		path = filepath.Dir(path)
+		isDir = true
+	}
+}
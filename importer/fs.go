@@ -18,6 +18,7 @@ package importer
 
 import (
 	"context"
+	"errors"
 	"fmt"
 	"io/fs"
 	"os"
@@ -31,47 +32,88 @@ import (
 	"github.com/PlakarKorp/kloset/connectors/importer"
 	"github.com/PlakarKorp/kloset/exclude"
 	"github.com/PlakarKorp/kloset/location"
+	"golang.org/x/sync/errgroup"
 )
 
 type FSImporter struct {
-	opts       *connectors.Options
-	rootDir    string
-	rootIsFile bool
-	realpath   string
+	opts  *connectors.Options
+	roots []*walkRoot
+
+	location *walkRoot // the root for location, even if walked within another
 
 	excludes *exclude.RuleSet
+	ignores  *ignoreFiles
+	skips    *skipRules
 
 	uidToName map[uint64]string
 	gidToName map[uint64]string
 	mu        sync.RWMutex
 
-	noxattr   bool
-	nocrossfs bool
-	devno     uint64
+	noxattr    bool
+	nocrossfs  bool
+	readblkdev bool
+	mounts     *mountFilter
+
+	noXattrDevs sync.Map // devices without xattr support
+
+	snapshot  *fsSnapshot   // template of the snapshots to make
+	snapshots []*fsSnapshot // snapshots made
+
+	parallelRoots bool
+	parallelWalk  bool
+	readdirBatch  int
+	changed       changedFiles
+	recordTimes   bool
+
+	report     *changeReport
+	stagingDir string // this run's directory in changed_files_staging_dir
+
+	filesFrom    string
+	filesFromNul bool
 }
 
 type file struct {
-	path string
-	info fs.FileInfo
+	path   string
+	origin string
+	info   fs.FileInfo
 }
 
 func init() {
-	importer.Register("fs", location.FLAG_LOCALFS, NewFSImporter)
+	importer.Register("fs", location.FLAG_LOCALFS|location.FLAG_NEEDACK, NewFSImporter)
 }
 
 func NewFSImporter(appCtx context.Context, opts *connectors.Options, name string, config map[string]string) (importer.Importer, error) {
-	location := config["location"]
-	rootDir := strings.TrimPrefix(location, name+"://")
-
-	if !filepath.IsAbs(rootDir) {
-		return nil, fmt.Errorf("not an absolute path %s", location)
+	roots, location, err := parseRoots(name, config)
+	if err != nil {
+		return nil, err
 	}
 
-	rootDir = filepath.Clean(rootDir)
+	parallelRoots, _ := strconv.ParseBool(config["parallel_roots"])
+	parallelWalk, _ := strconv.ParseBool(config["parallel_walk"])
 
+	var readdirBatch int
+	if config["readdir_batch"] != "" {
+		readdirBatch, err = strconv.Atoi(config["readdir_batch"])
+		if err != nil || readdirBatch < 0 {
+			return nil, fmt.Errorf("invalid readdir_batch %q", config["readdir_batch"])
+		}
+	}
+	filesFromNul, _ := strconv.ParseBool(config["files_from_nul"])
 	nocrossfs, _ := strconv.ParseBool(config["dont_traverse_fs"])
+	recordTimes, _ := strconv.ParseBool(config["record_times"])
+	readblkdev, _ := strconv.ParseBool(config["read_block_devices"])
 
-	realpath, wasFile, devno, err := realpathFollow(rootDir)
+	changed, err := parseChangedFiles(config)
+	if err != nil {
+		return nil, err
+	}
+
+	mounts, err := newMountFilter(config)
+	if err != nil {
+		return nil, err
+	}
+
+	snapshot, err := newFsSnapshot(config)
 	if err != nil {
 		return nil, err
 	}
@@ -83,15 +125,28 @@ func NewFSImporter(appCtx context.Context, opts *connectors.Options, name string
 
 	return &FSImporter{
 		opts:       opts,
-		rootDir:    rootDir,
-		rootIsFile: wasFile,
-		realpath:   realpath,
+		roots:      roots,
+		location:   location,
 		excludes:   excludes,
+		ignores:    newIgnoreFiles(config),
+		skips:      newSkipRules(config),
 		uidToName:  make(map[uint64]string),
 		gidToName:  make(map[uint64]string),
 		noxattr:    opts.NoXattr,
 		nocrossfs:  nocrossfs,
-		devno:      devno,
+		readblkdev: readblkdev,
+		mounts:     mounts,
+		snapshot:   snapshot,
+
+		parallelRoots: parallelRoots,
+		parallelWalk:  parallelWalk,
+		readdirBatch:  readdirBatch,
+		changed:       changed,
+		recordTimes:   recordTimes,
+		report:        newChangeReport(),
+
+		filesFrom:    config["files_from"],
+		filesFromNul: filesFromNul,
 	}, nil
 }
 
@@ -104,12 +159,55 @@ func (p *FSImporter) Type() string {
 }
 
 func (p *FSImporter) Flags() location.Flags {
-	return location.FLAG_LOCALFS
+	return location.FLAG_LOCALFS | location.FLAG_NEEDACK
 }
 
 func (p *FSImporter) Import(ctx context.Context, records chan<- *connectors.Record, results <-chan *connectors.Result) error {
 	defer close(records)
-	return p.walkDir_walker(ctx, records, p.opts.MaxConcurrency)
+
+	if p.snapshot != nil {
+		for _, r := range p.roots {
+			if err := p.createSnapshot(ctx, r); err != nil {
+				return err
+			}
+		}
+	}
+
+	if p.changed.retries > 0 {
+		dir, err := os.MkdirTemp(p.changed.stagingDir, "plakar-staging-*")
+		if err != nil {
+			return fmt.Errorf("failed to create staging directory: %w", err)
+		}
+		p.stagingDir = dir
+	}
+
+	// the records are counted so that the files found changed while
+	// being read can be recorded once they all have been
+	walked := make(chan *connectors.Record, cap(records))
+	forwarded := make(chan struct{})
+	go func() {
+		p.report.forward(walked, records)
+		close(forwarded)
+	}()
+	if results != nil {
+		go p.report.acknowledge(results)
+	} else {
+		p.report.done = true
+	}
+
+	var err error
+	if p.filesFrom != "" {
+		err = p.filesFrom_walker(ctx, walked, p.opts.MaxConcurrency)
+	} else {
+		err = p.walkDir_walker(ctx, walked, p.opts.MaxConcurrency)
+	}
+	close(walked)
+	<-forwarded
+	if err != nil {
+		return err
+	}
+
+	return p.report.flush(ctx, records)
 }
 
 func (f *FSImporter) walkDir_walker(ctx context.Context, records chan<- *connectors.Record, numWorkers int) error {
@@ -121,47 +219,121 @@ func (f *FSImporter) walkDir_walker(ctx context.Context, records chan<- *connect
 	}
 
 	// Add prefix directories first
-	walkDir_addPrefixDirectories(filepath.Dir(f.realpath), records)
-	if f.realpath != f.rootDir {
-		walkDir_addPrefixDirectories(f.rootDir, records)
+	seen := make(map[string]bool)
+	for _, r := range f.roots {
+		walkDir_addPrefixDirectories(filepath.Dir(r.realpath), records, seen)
+		if r.realpath != r.rootDir {
+			walkDir_addPrefixDirectories(r.rootDir, records, seen)
+		}
 	}
 
-	err := filepath.WalkDir(f.realpath, func(path string, d fs.DirEntry, err error) error {
+	var err error
+	if f.parallelRoots {
+		var g errgroup.Group
+		for _, r := range f.roots {
+			g.Go(func() error {
+				return f.walkRoot(ctx, r, jobs, records)
+			})
+		}
+		err = g.Wait()
+	} else {
+		for _, r := range f.roots {
+			if err = f.walkRoot(ctx, r, jobs, records); err != nil {
+				break
+			}
+		}
+	}
+
+	close(jobs)
+	wg.Wait()
+	return err
+}
+
+func (f *FSImporter) walkRoot(ctx context.Context, r *walkRoot, jobs chan<- file, records chan<- *connectors.Record) error {
+	root := r.walkPath()
+
+	visit := func(path string, d fs.DirEntry, err error) error {
 		if ctx.Err() != nil {
 			return err
 		}
 
+		origin := r.originPath(path)
+
 		if err != nil {
-			records <- connectors.NewError(path, err)
+			records <- connectors.NewError(origin, err)
 			return nil
 		}
 
-		if path != "/" {
-			if f.excludes.IsExcluded(path, d.IsDir()) {
-				return filepath.SkipDir
+		if origin != "/" {
+			if f.excludes.IsExcluded(origin, d.IsDir()) || f.ignores.excluded(root, path, d.IsDir()) {
+				if d.IsDir() {
+					return filepath.SkipDir
+				}
+				return nil
 			}
 		}
 
 		info, err := d.Info()
 		if err != nil {
-			records <- connectors.NewError(path, err)
+			records <- connectors.NewError(origin, err)
 			return nil
 		}
 
 		if d.IsDir() && f.nocrossfs {
-			same := isSameFs(f.devno, info)
+			same := isSameFs(r.devno, info)
 			if !same {
 				return filepath.SkipDir
 			}
 		}
 
-		jobs <- file{path: path, info: info}
+		if d.IsDir() && r.snapshot != nil && r.snapshot.nestedSubvolume(info) {
+			// snapshots left over by an interrupted backup are
+			// not part of the tree
+			if strings.HasPrefix(d.Name(), snapshotPrefix) {
+				return filepath.SkipDir
+			}
+			// it's another filesystem as far as dont_traverse_fs
+			// is concerned, but its content can't be read
+			if f.nocrossfs {
+				return filepath.SkipDir
+			}
+			records <- connectors.NewError(origin, errNestedSubvolume)
+			jobs <- file{path: path, origin: origin, info: info}
+			return filepath.SkipDir
+		}
+
+		// mount points are those of the live tree, even when
+		// walking a snapshot
+		if d.IsDir() && path != root {
+			if fstype, skip := f.mounts.skip(origin); skip {
+				// keep the mount point, not what is mounted there
+				f.logf("skipping %s filesystem mounted on %s\n", fstype, origin)
+				jobs <- file{path: path, origin: origin, info: info}
+				return filepath.SkipDir
+			}
+		}
+
+		if path != root && f.skips.skip(path, info) {
+			if d.IsDir() {
+				return filepath.SkipDir
+			}
+			return nil
+		}
+
+		if d.IsDir() {
+			if err := f.ignores.load(path); err != nil {
+				records <- connectors.NewError(filepath.Join(origin, f.ignores.name), err)
+			}
+		}
+
+		jobs <- file{path: path, origin: origin, info: info}
 		return nil
-	})
+	}
 
-	close(jobs)
-	wg.Wait()
-	return err
+	if f.parallelWalk {
+		return parallelWalkDir(ctx, root, f.opts.MaxConcurrency, f.readdirBatch, visit)
+	}
+	return streamWalkDir(ctx, root, f.readdirBatch, visit)
 }
 
 func (p *FSImporter) lookupIDs(uid, gid uint64) (uname, gname string) {
@@ -199,6 +371,12 @@ func (p *FSImporter) lookupIDs(uid, gid uint64) (uname, gname string) {
 	return
 }
 
+func (p *FSImporter) logf(format string, args ...any) {
+	if p.opts.Stdout != nil {
+		fmt.Fprintf(p.opts.Stdout, format, args...)
+	}
+}
+
 func realpathFollow(path string) (resolved string, wasFile bool, dev uint64, err error) {
 	info, err := os.Lstat(path)
 	if err != nil {
@@ -231,15 +409,54 @@ func (p *FSImporter) Ping(ctx context.Context) error {
 }
 
 func (p *FSImporter) Close(ctx context.Context) error {
-	return nil
+	var errs []error
+	for _, s := range p.snapshots {
+		errs = append(errs, s.destroy(ctx))
+	}
+	// staged files that were never read
+	if p.stagingDir != "" {
+		errs = append(errs, os.RemoveAll(p.stagingDir))
+	}
+	return errors.Join(errs...)
+}
+
+// createSnapshot makes the walk of r start from a snapshot, reusing
+// one already made if it holds r.
+func (p *FSImporter) createSnapshot(ctx context.Context, r *walkRoot) error {
+	source := r.realpath
+	if r.rootIsFile {
+		source = filepath.Dir(source)
+	}
+
+	source, err := p.snapshot.snapshotSource(source)
+	if err != nil {
+		return fmt.Errorf("failed to create snapshot: %w", err)
+	}
+
+	for _, s := range p.snapshots {
+		if s.source == source {
+			return r.useSnapshot(s)
+		}
+	}
+
+	snapshot := *p.snapshot
+	if err := snapshot.create(ctx, source); err != nil {
+		return err
+	}
+	p.snapshots = append(p.snapshots, &snapshot)
+	return r.useSnapshot(&snapshot)
 }
 
 func (p *FSImporter) Root() string {
-	path := p.rootDir
-	if p.rootIsFile {
-		path = filepath.Dir(path)
+	var paths []string
+	for _, r := range p.roots {
+		path := r.rootDir
+		if r.rootIsFile {
+			path = filepath.Dir(path)
+		}
+		paths = append(paths, path)
 	}
-	return toslash(path)
+	return toslash(commonRoot(paths))
 }
 
 // convert paths to the internal format.  For unix nothing changes,
@@ -0,0 +1,106 @@
+/*
+ * Copyright (c) 2023 Gilles Chehade <gilles@poolp.org>
+ *
+ * Permission to use, copy, modify, and distribute this software for any
+ * purpose with or without fee is hereby granted, provided that the above
+ * copyright notice and this permission notice appear in all copies.
+ *
+ * THE SOFTWARE IS PROVIDED "AS IS" AND THE AUTHOR DISCLAIMS ALL WARRANTIES
+ * WITH REGARD TO THIS SOFTWARE INCLUDING ALL IMPLIED WARRANTIES OF
+ * MERCHANTABILITY AND FITNESS. IN NO EVENT SHALL THE AUTHOR BE LIABLE FOR
+ * ANY SPECIAL, DIRECT, INDIRECT, OR CONSEQUENTIAL DAMAGES OR ANY DAMAGES
+ * WHATSOEVER RESULTING FROM LOSS OF USE, DATA OR PROFITS, WHETHER IN AN
+ * ACTION OF CONTRACT, NEGLIGENCE OR OTHER TORTIOUS ACTION, ARISING OUT OF
+ * OR IN CONNECTION WITH THE USE OR PERFORMANCE OF THIS SOFTWARE.
+ */
+
+package importer
+
+import (
+	"errors"
+	"io/fs"
+	"path/filepath"
+	"sync"
+
+	"github.com/PlakarKorp/kloset/exclude"
+)
+
+const defaultIgnoreFile = ".plakarignore"
+
+// ignoreFiles holds the rules of the per-directory ignore files found
+// during the walk.  Like .gitignore, the patterns of a file are
+// relative to its directory and apply to the whole subtree, and the
+// rules of a deeper file take precedence over those of its parents.
+type ignoreFiles struct {
+	name string
+
+	mu    sync.RWMutex
+	rules map[string]*exclude.RuleSet // by directory, only those with a file
+}
+
+func newIgnoreFiles(config map[string]string) *ignoreFiles {
+	name, ok := config["ignore_file"]
+	if !ok {
+		name = defaultIgnoreFile
+	}
+	if name == "" {
+		return nil
+	}
+	return &ignoreFiles{
+		name:  name,
+		rules: make(map[string]*exclude.RuleSet),
+	}
+}
+
+// load reads the ignore file of dir, if it has one.
+func (ig *ignoreFiles) load(dir string) error {
+	if ig == nil {
+		return nil
+	}
+
+	path := filepath.Join(dir, ig.name)
+	rules := exclude.NewRuleSet()
+	if err := rules.AddRulesFromFile(path); err != nil {
+		if errors.Is(err, fs.ErrNotExist) {
+			return nil
+		}
+		return err
+	}
+	ig.mu.Lock()
+	ig.rules[dir] = rules
+	ig.mu.Unlock()
+	return nil
+}
+
+// excluded tells whether path is ignored by the files of its parent
+// directories, up to root.
+func (ig *ignoreFiles) excluded(root, path string, isDir bool) bool {
+	if ig == nil {
+		return false
+	}
+
+	ig.mu.RLock()
+	defer ig.mu.RUnlock()
+
+	dir := path
+	for dir != root {
+		dir = filepath.Dir(dir)
+
+		rules, ok := ig.rules[dir]
+		if ok {
+			rel, err := filepath.Rel(dir, path)
+			if err != nil {
+				return false
+			}
+			excluded, rule, err := rules.Match(filepath.ToSlash(rel), isDir)
+			if err == nil && rule != nil {
+				return excluded
+			}
+		}
+
+		if dir == filepath.Dir(dir) {
+			break
+		}
+	}
+	return false
+}
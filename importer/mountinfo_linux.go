@@ -0,0 +1,62 @@
+//go:build linux
+
+package importer
+
+import (
+	"bufio"
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+)
+
+// readMounts parses /proc/self/mountinfo into a map of mount points to
+// filesystem types.  When several filesystems are stacked on the same
+// mount point, the last one, which is the visible one, wins.
+func readMounts() (map[string]string, error) {
+	fp, err := os.Open("/proc/self/mountinfo")
+	if err != nil {
+		return nil, err
+	}
+	defer fp.Close()
+
+	mounts := make(map[string]string)
+	sc := bufio.NewScanner(fp)
+	for sc.Scan() {
+		// 36 35 98:0 /mnt1 /mnt2 rw,noatime master:1 - ext3 /dev/root rw
+		fields := strings.Fields(sc.Text())
+		sep := -1
+		for i := 6; i < len(fields); i++ {
+			if fields[i] == "-" {
+				sep = i
+				break
+			}
+		}
+		if sep == -1 || sep+1 >= len(fields) {
+			return nil, fmt.Errorf("malformed mountinfo line %q", sc.Text())
+		}
+		mounts[unescapeMountPath(fields[4])] = fields[sep+1]
+	}
+	return mounts, sc.Err()
+}
+
+// unescapeMountPath decodes the octal escapes (\040 for a space) the
+// kernel uses in mountinfo.
+func unescapeMountPath(s string) string {
+	if !strings.Contains(s, `\`) {
+		return s
+	}
+
+	var b strings.Builder
+	for i := 0; i < len(s); i++ {
+		if s[i] == '\\' && i+4 <= len(s) {
+			if c, err := strconv.ParseUint(s[i+1:i+4], 8, 8); err == nil {
+				b.WriteByte(byte(c))
+				i += 3
+				continue
+			}
+		}
+		b.WriteByte(s[i])
+	}
+	return b.String()
+}
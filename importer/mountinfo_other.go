@@ -0,0 +1,11 @@
+//go:build !linux
+
+package importer
+
+import (
+	"errors"
+)
+
+func readMounts() (map[string]string, error) {
+	return nil, errors.New("mount filtering is only supported on Linux")
+}
@@ -0,0 +1,114 @@
+/*
+ * Copyright (c) 2023 Gilles Chehade <gilles@poolp.org>
+ *
+ * Permission to use, copy, modify, and distribute this software for any
+ * purpose with or without fee is hereby granted, provided that the above
+ * copyright notice and this permission notice appear in all copies.
+ *
+ * THE SOFTWARE IS PROVIDED "AS IS" AND THE AUTHOR DISCLAIMS ALL WARRANTIES
+ * WITH REGARD TO THIS SOFTWARE INCLUDING ALL IMPLIED WARRANTIES OF
+ * MERCHANTABILITY AND FITNESS. IN NO EVENT SHALL THE AUTHOR BE LIABLE FOR
+ * ANY SPECIAL, DIRECT, INDIRECT, OR CONSEQUENTIAL DAMAGES OR ANY DAMAGES
+ * WHATSOEVER RESULTING FROM LOSS OF USE, DATA OR PROFITS, WHETHER IN AN
+ * ACTION OF CONTRACT, NEGLIGENCE OR OTHER TORTIOUS ACTION, ARISING OUT OF
+ * OR IN CONNECTION WITH THE USE OR PERFORMANCE OF THIS SOFTWARE.
+ */
+
+package importer
+
+import (
+	"fmt"
+	"path/filepath"
+	"strconv"
+	"strings"
+)
+
+// virtualFsTypes are the pseudo, memory-backed, overlay and network
+// filesystems skipped by skip_virtual_fs.
+var virtualFsTypes = []string{
+	"autofs", "binfmt_misc", "bpf", "cgroup", "cgroup2", "configfs",
+	"debugfs", "devpts", "devtmpfs", "efivarfs", "fusectl", "hugetlbfs",
+	"mqueue", "nsfs", "overlay", "proc", "pstore", "ramfs", "rpc_pipefs",
+	"securityfs", "selinuxfs", "sysfs", "tmpfs", "tracefs",
+
+	"9p", "afs", "ceph", "cifs", "fuse.sshfs", "glusterfs", "lustre",
+	"ncpfs", "nfs", "nfs4", "smb3", "smbfs",
+}
+
+// mountFilter decides which mount points the walk crosses into.  It is
+// nil unless one of its options is set.
+type mountFilter struct {
+	mounts map[string]string // mount point -> filesystem type
+
+	typeAllow  map[string]bool
+	typeDeny   map[string]bool
+	pointAllow map[string]bool
+	pointDeny  map[string]bool
+}
+
+func newMountFilter(config map[string]string) (*mountFilter, error) {
+	virtual, _ := strconv.ParseBool(config["skip_virtual_fs"])
+
+	m := &mountFilter{
+		typeAllow:  parseList(config["fstype_allow"], nil),
+		typeDeny:   parseList(config["fstype_deny"], nil),
+		pointAllow: parseList(config["mountpoint_allow"], filepath.Clean),
+		pointDeny:  parseList(config["mountpoint_deny"], filepath.Clean),
+	}
+	if virtual {
+		for _, fstype := range virtualFsTypes {
+			m.typeDeny[fstype] = true
+		}
+	}
+
+	if len(m.typeAllow) == 0 && len(m.typeDeny) == 0 &&
+		len(m.pointAllow) == 0 && len(m.pointDeny) == 0 {
+		return nil, nil
+	}
+
+	mounts, err := readMounts()
+	if err != nil {
+		return nil, fmt.Errorf("failed to read the mount table: %w", err)
+	}
+	m.mounts = mounts
+	return m, nil
+}
+
+func parseList(s string, clean func(string) string) map[string]bool {
+	ret := make(map[string]bool)
+	for _, item := range strings.Split(s, ",") {
+		item = strings.TrimSpace(item)
+		if item == "" {
+			continue
+		}
+		if clean != nil {
+			item = clean(item)
+		}
+		ret[item] = true
+	}
+	return ret
+}
+
+// skip tells whether the walk should stay out of dir, along with the
+// type of the filesystem mounted there.
+func (m *mountFilter) skip(dir string) (string, bool) {
+	if m == nil {
+		return "", false
+	}
+
+	fstype, ok := m.mounts[dir]
+	if !ok {
+		return "", false
+	}
+
+	switch {
+	case m.pointAllow[dir]:
+		return fstype, false
+	case m.pointDeny[dir]:
+		return fstype, true
+	case len(m.typeAllow) != 0 && !m.typeAllow[fstype]:
+		return fstype, true
+	default:
+		return fstype, m.typeDeny[fstype]
+	}
+}
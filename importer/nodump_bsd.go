@@ -0,0 +1,19 @@
+//go:build darwin || freebsd || netbsd || openbsd || dragonfly
+
+package importer
+
+import (
+	"io/fs"
+	"syscall"
+)
+
+const ufNodump = 0x00000001 // UF_NODUMP, chflags nodump
+
+// isNodump reports whether path carries the nodump flag.
+func isNodump(path string, info fs.FileInfo) bool {
+	sb, ok := info.Sys().(*syscall.Stat_t)
+	if !ok {
+		return false
+	}
+	return sb.Flags&ufNodump != 0
+}
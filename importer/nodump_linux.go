@@ -0,0 +1,32 @@
+//go:build linux
+
+package importer
+
+import (
+	"io/fs"
+
+	"golang.org/x/sys/unix"
+)
+
+const fsNodumpFl = 0x00000040 // FS_NODUMP_FL, chattr +d
+
+// isNodump reports whether path carries the nodump attribute.  Only
+// regular files and directories are checked, as the flags can only
+// be read from an open descriptor.
+func isNodump(path string, info fs.FileInfo) bool {
+	if !info.Mode().IsRegular() && !info.IsDir() {
+		return false
+	}
+
+	fd, err := unix.Open(path, unix.O_RDONLY|unix.O_NONBLOCK|unix.O_NOFOLLOW|unix.O_CLOEXEC, 0)
+	if err != nil {
+		return false
+	}
+	defer unix.Close(fd)
+
+	flags, err := unix.IoctlGetUint32(fd, unix.FS_IOC_GETFLAGS)
+	if err != nil {
+		return false
+	}
+	return flags&fsNodumpFl != 0
+}
@@ -0,0 +1,11 @@
+//go:build !linux && !darwin && !freebsd && !netbsd && !openbsd && !dragonfly
+
+package importer
+
+import (
+	"io/fs"
+)
+
+func isNodump(path string, info fs.FileInfo) bool {
+	return false
+}
@@ -0,0 +1,162 @@
+/*
+ * Copyright (c) 2023 Gilles Chehade <gilles@poolp.org>
+ *
+ * Permission to use, copy, modify, and distribute this software for any
+ * purpose with or without fee is hereby granted, provided that the above
+ * copyright notice and this permission notice appear in all copies.
+ *
+ * THE SOFTWARE IS PROVIDED "AS IS" AND THE AUTHOR DISCLAIMS ALL WARRANTIES
+ * WITH REGARD TO THIS SOFTWARE INCLUDING ALL IMPLIED WARRANTIES OF
+ * MERCHANTABILITY AND FITNESS. IN NO EVENT SHALL THE AUTHOR BE LIABLE FOR
+ * ANY SPECIAL, DIRECT, INDIRECT, OR CONSEQUENTIAL DAMAGES OR ANY DAMAGES
+ * WHATSOEVER RESULTING FROM LOSS OF USE, DATA OR PROFITS, WHETHER IN AN
+ * ACTION OF CONTRACT, NEGLIGENCE OR OTHER TORTIOUS ACTION, ARISING OUT OF
+ * OR IN CONNECTION WITH THE USE OR PERFORMANCE OF THIS SOFTWARE.
+ */
+
+package importer
+
+import (
+	"context"
+	"errors"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"sync"
+)
+
+// dirQueue holds the directories left to read, one stack per reader.
+// A reader pops from its own stack, which keeps the walk depth-first
+// and close to what it just read, and steals the oldest directory of
+// another reader when its stack is empty.
+type dirQueue struct {
+	mu      sync.Mutex
+	cond    *sync.Cond
+	stacks  [][]string
+	pending int // directories queued or being read
+	stopped bool
+}
+
+func newDirQueue(readers int) *dirQueue {
+	q := &dirQueue{stacks: make([][]string, readers)}
+	q.cond = sync.NewCond(&q.mu)
+	return q
+}
+
+func (q *dirQueue) push(reader int, dir string) {
+	q.mu.Lock()
+	q.stacks[reader] = append(q.stacks[reader], dir)
+	q.pending++
+	q.mu.Unlock()
+	q.cond.Signal()
+}
+
+// pop returns the next directory for reader to read, waiting for one
+// if needed.  It returns false once the walk is over.
+func (q *dirQueue) pop(reader int) (string, bool) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	for {
+		if q.stopped || q.pending == 0 {
+			return "", false
+		}
+
+		if stack := q.stacks[reader]; len(stack) != 0 {
+			dir := stack[len(stack)-1]
+			q.stacks[reader] = stack[:len(stack)-1]
+			return dir, true
+		}
+
+		for i, stack := range q.stacks {
+			if len(stack) != 0 {
+				dir := stack[0]
+				q.stacks[i] = stack[1:]
+				return dir, true
+			}
+		}
+
+		q.cond.Wait()
+	}
+}
+
+// done marks a directory popped earlier as fully read.
+func (q *dirQueue) done() {
+	q.mu.Lock()
+	q.pending--
+	last := q.pending == 0
+	q.mu.Unlock()
+	if last {
+		q.cond.Broadcast()
+	}
+}
+
+func (q *dirQueue) stop() {
+	q.mu.Lock()
+	q.stopped = true
+	q.mu.Unlock()
+	q.cond.Broadcast()
+}
+
+// parallelWalkDir is filepath.WalkDir with several directories read at
+// once, batch entries at a time if batch > 0 as with streamWalkDir.
+// fn is called concurrently, and on a directory before any of its
+// entries, but siblings are visited in no particular order.  As with
+// filepath.WalkDir, fn returning filepath.SkipDir on a directory skips
+// its content, and on a file skips the rest of its directory.  Any
+// other error, or ctx being done, stops the walk.
+func parallelWalkDir(ctx context.Context, root string, readers, batch int, fn fs.WalkDirFunc) error {
+	readers = max(readers, 1)
+
+	info, err := os.Lstat(root)
+	if err != nil {
+		err = fn(root, nil, err)
+	} else {
+		err = fn(root, fs.FileInfoToDirEntry(info), nil)
+	}
+	if errors.Is(err, filepath.SkipDir) || errors.Is(err, filepath.SkipAll) {
+		return nil
+	}
+	if err != nil || info == nil || !info.IsDir() {
+		return err
+	}
+
+	q := newDirQueue(readers)
+	q.push(0, root)
+
+	var (
+		wg       sync.WaitGroup
+		errOnce  sync.Once
+		firstErr error
+	)
+	for i := range readers {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for {
+				dir, ok := q.pop(i)
+				if !ok {
+					return
+				}
+				err := readEntries(ctx, dir, batch, fn, func(path string, entry fs.DirEntry) error {
+					if entry.IsDir() {
+						q.push(i, path)
+					}
+					return nil
+				})
+				q.done()
+				if err != nil {
+					errOnce.Do(func() { firstErr = err })
+					q.stop()
+					return
+				}
+			}
+		}()
+	}
+	wg.Wait()
+
+	if errors.Is(firstErr, filepath.SkipAll) {
+		return nil
+	}
+	return firstErr
+}
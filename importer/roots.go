@@ -0,0 +1,150 @@
+/*
+ * Copyright (c) 2023 Gilles Chehade <gilles@poolp.org>
+ *
+ * Permission to use, copy, modify, and distribute this software for any
+ * purpose with or without fee is hereby granted, provided that the above
+ * copyright notice and this permission notice appear in all copies.
+ *
+ * THE SOFTWARE IS PROVIDED "AS IS" AND THE AUTHOR DISCLAIMS ALL WARRANTIES
+ * WITH REGARD TO THIS SOFTWARE INCLUDING ALL IMPLIED WARRANTIES OF
+ * MERCHANTABILITY AND FITNESS. IN NO EVENT SHALL THE AUTHOR BE LIABLE FOR
+ * ANY SPECIAL, DIRECT, INDIRECT, OR CONSEQUENTIAL DAMAGES OR ANY DAMAGES
+ * WHATSOEVER RESULTING FROM LOSS OF USE, DATA OR PROFITS, WHETHER IN AN
+ * ACTION OF CONTRACT, NEGLIGENCE OR OTHER TORTIOUS ACTION, ARISING OUT OF
+ * OR IN CONNECTION WITH THE USE OR PERFORMANCE OF THIS SOFTWARE.
+ */
+
+package importer
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+)
+
+// walkRoot is one of the trees imported.
+type walkRoot struct {
+	rootDir    string
+	rootIsFile bool
+	realpath   string
+	devno      uint64
+
+	snapshot *fsSnapshot
+	snapRoot string // realpath within the snapshot, if any
+}
+
+// parseRoots returns the trees to import: location and the optional
+// roots list, sorted.  Roots found within another one are dropped, as
+// they are walked already.  The root for location is also returned on
+// its own.
+func parseRoots(name string, config map[string]string) ([]*walkRoot, *walkRoot, error) {
+	locations := []string{config["location"]}
+	if config["roots"] != "" {
+		locations = append(locations, filepath.SplitList(config["roots"])...)
+	}
+
+	var roots []*walkRoot
+	for _, location := range locations {
+		rootDir := strings.TrimPrefix(location, name+"://")
+		if !filepath.IsAbs(rootDir) {
+			return nil, nil, fmt.Errorf("not an absolute path %s", location)
+		}
+		rootDir = filepath.Clean(rootDir)
+
+		realpath, wasFile, devno, err := realpathFollow(rootDir)
+		if err != nil {
+			return nil, nil, err
+		}
+
+		roots = append(roots, &walkRoot{
+			rootDir:    rootDir,
+			rootIsFile: wasFile,
+			realpath:   realpath,
+			devno:      devno,
+		})
+	}
+
+	location := roots[0]
+
+	// parents sort before their children
+	slices.SortStableFunc(roots, func(a, b *walkRoot) int {
+		return strings.Compare(a.realpath, b.realpath)
+	})
+
+	var kept []*walkRoot
+	for _, r := range roots {
+		if !slices.ContainsFunc(kept, r.within) {
+			kept = append(kept, r)
+		}
+	}
+	return kept, location, nil
+}
+
+// within tells whether r is walked as part of other.
+func (r *walkRoot) within(other *walkRoot) bool {
+	if r.realpath == other.realpath {
+		return true
+	}
+	if other.rootIsFile {
+		return false
+	}
+	return strings.HasPrefix(r.realpath, strings.TrimSuffix(other.realpath, string(filepath.Separator))+string(filepath.Separator))
+}
+
+// walkPath returns where the walk of r starts.
+func (r *walkRoot) walkPath() string {
+	if r.snapRoot != "" {
+		return r.snapRoot
+	}
+	return r.realpath
+}
+
+// useSnapshot makes the walk of r start from within snapshot, which
+// must hold it.
+func (r *walkRoot) useSnapshot(snapshot *fsSnapshot) error {
+	root, ok := snapshot.rootOf(r.realpath)
+	if !ok {
+		return fmt.Errorf("%s is not part of the snapshot of %s", r.realpath, snapshot.source)
+	}
+	r.snapshot = snapshot
+	r.snapRoot = root
+
+	// dont_traverse_fs compares against the snapshot's device
+	if !r.rootIsFile {
+		info, err := os.Lstat(root)
+		if err != nil {
+			return err
+		}
+		r.devno = dirDevice(info)
+	}
+	return nil
+}
+
+// originPath maps a path walked within the snapshot back to where it
+// lives in the live tree.
+func (r *walkRoot) originPath(path string) string {
+	if r.snapRoot == "" {
+		return path
+	}
+	return filepath.Join(r.realpath, strings.TrimPrefix(path, r.snapRoot))
+}
+
+// commonRoot returns the deepest directory holding all of paths.
+func commonRoot(paths []string) string {
+	common := paths[0]
+	for _, path := range paths[1:] {
+		for !strings.HasPrefix(path, common) ||
+			(len(path) > len(common) && path[len(common)] != filepath.Separator &&
+				!strings.HasSuffix(common, string(filepath.Separator))) {
+			parent := filepath.Dir(common)
+			if parent == common {
+				// no common ancestor, as with different volumes
+				return ""
+			}
+			common = parent
+		}
+	}
+	return common
+}
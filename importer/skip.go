@@ -0,0 +1,90 @@
+/*
+ * Copyright (c) 2023 Gilles Chehade <gilles@poolp.org>
+ *
+ * Permission to use, copy, modify, and distribute this software for any
+ * purpose with or without fee is hereby granted, provided that the above
+ * copyright notice and this permission notice appear in all copies.
+ *
+ * THE SOFTWARE IS PROVIDED "AS IS" AND THE AUTHOR DISCLAIMS ALL WARRANTIES
+ * WITH REGARD TO THIS SOFTWARE INCLUDING ALL IMPLIED WARRANTIES OF
+ * MERCHANTABILITY AND FITNESS. IN NO EVENT SHALL THE AUTHOR BE LIABLE FOR
+ * ANY SPECIAL, DIRECT, INDIRECT, OR CONSEQUENTIAL DAMAGES OR ANY DAMAGES
+ * WHATSOEVER RESULTING FROM LOSS OF USE, DATA OR PROFITS, WHETHER IN AN
+ * ACTION OF CONTRACT, NEGLIGENCE OR OTHER TORTIOUS ACTION, ARISING OUT OF
+ * OR IN CONNECTION WITH THE USE OR PERFORMANCE OF THIS SOFTWARE.
+ */
+
+package importer
+
+import (
+	"bytes"
+	"io"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+)
+
+// cachedirSignature starts a valid CACHEDIR.TAG, as defined by
+// https://bford.info/cachedir/
+const cachedirSignature = "Signature: 8a477f597d28d172789f06886806bc55"
+
+// skipRules are the exclusions that the tree itself asks for, as
+// opposed to the configured exclude patterns.
+type skipRules struct {
+	caches  bool     // directories tagged with a CACHEDIR.TAG
+	markers []string // directories holding one of these files
+	nodump  bool     // paths with the nodump attribute
+}
+
+func newSkipRules(config map[string]string) *skipRules {
+	caches, _ := strconv.ParseBool(config["exclude_caches"])
+	nodump, _ := strconv.ParseBool(config["exclude_nodump"])
+
+	var markers []string
+	for _, name := range strings.Split(config["exclude_if_present"], ",") {
+		if name = strings.TrimSpace(name); name != "" {
+			markers = append(markers, name)
+		}
+	}
+
+	return &skipRules{
+		caches:  caches,
+		markers: markers,
+		nodump:  nodump,
+	}
+}
+
+// skip tells whether path should be left out of the backup.
+func (s *skipRules) skip(path string, info fs.FileInfo) bool {
+	if s.nodump && isNodump(path, info) {
+		return true
+	}
+
+	if !info.IsDir() {
+		return false
+	}
+
+	for _, name := range s.markers {
+		if _, err := os.Lstat(filepath.Join(path, name)); err == nil {
+			return true
+		}
+	}
+
+	return s.caches && isCacheDir(path)
+}
+
+func isCacheDir(path string) bool {
+	fp, err := os.Open(filepath.Join(path, "CACHEDIR.TAG"))
+	if err != nil {
+		return false
+	}
+	defer fp.Close()
+
+	buf := make([]byte, len(cachedirSignature))
+	if _, err := io.ReadFull(fp, buf); err != nil {
+		return false
+	}
+	return bytes.Equal(buf, []byte(cachedirSignature))
+}
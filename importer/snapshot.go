@@ -0,0 +1,254 @@
+/*
+ * Copyright (c) 2023 Gilles Chehade <gilles@poolp.org>
+ *
+ * Permission to use, copy, modify, and distribute this software for any
+ * purpose with or without fee is hereby granted, provided that the above
+ * copyright notice and this permission notice appear in all copies.
+ *
+ * THE SOFTWARE IS PROVIDED "AS IS" AND THE AUTHOR DISCLAIMS ALL WARRANTIES
+ * WITH REGARD TO THIS SOFTWARE INCLUDING ALL IMPLIED WARRANTIES OF
+ * MERCHANTABILITY AND FITNESS. IN NO EVENT SHALL THE AUTHOR BE LIABLE FOR
+ * ANY SPECIAL, DIRECT, INDIRECT, OR CONSEQUENTIAL DAMAGES OR ANY DAMAGES
+ * WHATSOEVER RESULTING FROM LOSS OF USE, DATA OR PROFITS, WHETHER IN AN
+ * ACTION OF CONTRACT, NEGLIGENCE OR OTHER TORTIOUS ACTION, ARISING OUT OF
+ * OR IN CONNECTION WITH THE USE OR PERFORMANCE OF THIS SOFTWARE.
+ */
+
+package importer
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// btrfsSubvolumeIno is the inode number of the root of every btrfs
+// subvolume.
+const btrfsSubvolumeIno = 256
+
+// btrfsEmptySubvolumeIno is the inode number of the empty directories
+// standing for nested subvolumes in a btrfs snapshot.
+const btrfsEmptySubvolumeIno = 2
+
+// snapshotDestroyTimeout bounds the teardown of a snapshot, which must
+// happen even if the import was cancelled.
+const snapshotDestroyTimeout = 5 * time.Minute
+
+// snapshotPrefix starts the names of the btrfs snapshots made in the
+// tree, which are skipped if left over by an interrupted backup.
+const snapshotPrefix = ".plakar-snapshot-"
+
+var errNestedSubvolume = errors.New("nested btrfs subvolume, not part of the snapshot")
+
+// fsSnapshot is a point-in-time copy of the filesystem holding the
+// imported tree, walked instead of the live tree.  A btrfs snapshot
+// covers a whole subvolume and is shared by the roots it holds; the
+// command makes one snapshot per root.
+type fsSnapshot struct {
+	kind      string // "btrfs" or "command"
+	dir       string // where btrfs snapshots are created
+	createCmd string
+	deleteCmd string
+
+	source string // the snapshotted path: the subvolume with btrfs
+	path   string // the btrfs subvolume created, if any
+	root   string // source within the snapshot
+}
+
+func newFsSnapshot(config map[string]string) (*fsSnapshot, error) {
+	s := &fsSnapshot{
+		kind:      config["snapshot"],
+		dir:       config["snapshot_dir"],
+		createCmd: config["snapshot_create"],
+		deleteCmd: config["snapshot_delete"],
+	}
+
+	switch s.kind {
+	case "":
+		return nil, nil
+	case "btrfs":
+	case "command":
+		if s.createCmd == "" {
+			return nil, fmt.Errorf("snapshot_create is required with snapshot=command")
+		}
+	default:
+		return nil, fmt.Errorf("invalid snapshot type %q", s.kind)
+	}
+	return s, nil
+}
+
+// snapshotSource returns what must be snapshotted for source to be
+// part of the snapshot.
+func (s *fsSnapshot) snapshotSource(source string) (string, error) {
+	if s.kind == "btrfs" {
+		return btrfsSubvolume(source)
+	}
+	return source, nil
+}
+
+// create snapshots source, as returned by snapshotSource.
+func (s *fsSnapshot) create(ctx context.Context, source string) error {
+	s.source = source
+
+	var err error
+	switch s.kind {
+	case "btrfs":
+		err = s.createBtrfs(ctx, source)
+	case "command":
+		s.root, err = s.createCommand(ctx, source)
+	}
+	if err != nil {
+		return fmt.Errorf("failed to create snapshot: %w", err)
+	}
+	return nil
+}
+
+// rootOf returns the path of path within the snapshot, if it holds it.
+func (s *fsSnapshot) rootOf(path string) (string, bool) {
+	rel, err := filepath.Rel(s.source, path)
+	if err != nil || rel == ".." || strings.HasPrefix(rel, ".."+string(filepath.Separator)) {
+		return "", false
+	}
+	return filepath.Join(s.root, rel), true
+}
+
+func (s *fsSnapshot) createBtrfs(ctx context.Context, subvol string) error {
+	dir := s.dir
+	if dir == "" {
+		dir = subvol
+	}
+	name := fmt.Sprintf("%s%d-%d", snapshotPrefix, os.Getpid(), time.Now().UnixNano())
+	path := filepath.Join(dir, name)
+
+	if _, err := run(ctx, nil, "btrfs", "subvolume", "snapshot", "-r", subvol, path); err != nil {
+		return err
+	}
+	s.path = path
+	s.root = path
+	return nil
+}
+
+// nestedSubvolume tells whether info, found in a btrfs snapshot, is
+// the empty directory standing for a nested subvolume, whose content
+// is not part of the snapshot.
+func (s *fsSnapshot) nestedSubvolume(info fs.FileInfo) bool {
+	if s.kind != "btrfs" || !info.IsDir() {
+		return false
+	}
+	_, ino, _, ok := statIdentity(info)
+	return ok && ino == btrfsEmptySubvolumeIno
+}
+
+// btrfsSubvolume returns the root of the subvolume holding path: the
+// closest parent on the same device with the subvolume root inode.
+func btrfsSubvolume(source string) (string, error) {
+	path := source
+	info, err := os.Stat(path)
+	if err != nil {
+		return "", err
+	}
+	dev, _, _, ok := statIdentity(info)
+	if !ok {
+		return "", fmt.Errorf("btrfs snapshots are not supported on this system")
+	}
+
+	for {
+		info, err := os.Stat(path)
+		if err != nil {
+			return "", err
+		}
+		pdev, ino, _, _ := statIdentity(info)
+		if pdev != dev {
+			break
+		}
+		if ino == btrfsSubvolumeIno {
+			return path, nil
+		}
+
+		parent := filepath.Dir(path)
+		if parent == path {
+			break
+		}
+		path = parent
+	}
+	return "", fmt.Errorf("%s is not on a btrfs subvolume", source)
+}
+
+// createCommand runs the configured command, which must print the
+// path of source within the snapshot it created.
+func (s *fsSnapshot) createCommand(ctx context.Context, source string) (string, error) {
+	env := []string{"PLAKAR_SNAPSHOT_SOURCE=" + source}
+	out, err := run(ctx, env, "/bin/sh", "-c", s.createCmd)
+	if err != nil {
+		return "", err
+	}
+
+	root := strings.TrimSpace(string(out))
+	if !filepath.IsAbs(root) {
+		return "", fmt.Errorf("snapshot command returned %q, not an absolute path", root)
+	}
+	if info, err := os.Stat(root); err != nil {
+		return "", err
+	} else if !info.IsDir() {
+		return "", fmt.Errorf("snapshot command returned %q, not a directory", root)
+	}
+	return filepath.Clean(root), nil
+}
+
+// destroy tears the snapshot down.  It's safe to call if create
+// failed or wasn't called, and it's not interrupted by the
+// cancellation of ctx.
+func (s *fsSnapshot) destroy(ctx context.Context) error {
+	ctx, cancel := context.WithTimeout(context.WithoutCancel(ctx), snapshotDestroyTimeout)
+	defer cancel()
+
+	var err error
+	switch s.kind {
+	case "btrfs":
+		if s.path == "" {
+			return nil
+		}
+		_, err = run(ctx, nil, "btrfs", "subvolume", "delete", s.path)
+		s.path = ""
+
+	case "command":
+		if s.root == "" || s.deleteCmd == "" {
+			return nil
+		}
+		env := []string{
+			"PLAKAR_SNAPSHOT_SOURCE=" + s.source,
+			"PLAKAR_SNAPSHOT_PATH=" + s.root,
+		}
+		_, err = run(ctx, env, "/bin/sh", "-c", s.deleteCmd)
+		s.root = ""
+	}
+
+	if err != nil {
+		return fmt.Errorf("failed to delete snapshot: %w", err)
+	}
+	return nil
+}
+
+func run(ctx context.Context, env []string, name string, args ...string) ([]byte, error) {
+	var stdout, stderr bytes.Buffer
+
+	cmd := exec.CommandContext(ctx, name, args...)
+	cmd.Env = append(os.Environ(), env...)
+	cmd.Stdout = &stdout
+	cmd.Stderr = &stderr
+
+	if err := cmd.Run(); err != nil {
+		if msg := strings.TrimSpace(stderr.String()); msg != "" {
+			return nil, fmt.Errorf("%s: %w: %s", name, err, msg)
+		}
+		return nil, fmt.Errorf("%s: %w", name, err)
+	}
+	return stdout.Bytes(), nil
+}
@@ -0,0 +1,32 @@
+//go:build linux || darwin || freebsd
+
+package importer
+
+import (
+	"io/fs"
+	"os"
+	"syscall"
+
+	"golang.org/x/sys/unix"
+)
+
+// isSparse reports whether the regular file at path has holes.  Only
+// files that occupy less blocks than their size are probed.
+func isSparse(path string, info fs.FileInfo) bool {
+	sb, ok := info.Sys().(*syscall.Stat_t)
+	if !ok || int64(sb.Blocks)*512 >= info.Size() {
+		return false
+	}
+
+	fp, err := os.Open(path)
+	if err != nil {
+		return false
+	}
+	defer fp.Close()
+
+	hole, err := fp.Seek(0, unix.SEEK_HOLE)
+	if err != nil {
+		return false
+	}
+	return hole < info.Size()
+}
@@ -0,0 +1,11 @@
+//go:build !linux && !darwin && !freebsd
+
+package importer
+
+import (
+	"io/fs"
+)
+
+func isSparse(path string, info fs.FileInfo) bool {
+	return false
+}
@@ -0,0 +1,26 @@
+//go:build linux || openbsd || solaris || aix
+
+package importer
+
+import (
+	"io/fs"
+	"syscall"
+)
+
+// statIdentity returns the device, inode and ctime of a file.
+func statIdentity(info fs.FileInfo) (dev, ino uint64, ctime int64, ok bool) {
+	sb, ok := info.Sys().(*syscall.Stat_t)
+	if !ok {
+		return 0, 0, 0, false
+	}
+	return uint64(sb.Dev), uint64(sb.Ino), sb.Ctim.Nano(), true
+}
+
+// statTimes returns the access and change times of a file.
+func statTimes(info fs.FileInfo) (atime, ctime int64, ok bool) {
+	sb, ok := info.Sys().(*syscall.Stat_t)
+	if !ok {
+		return 0, 0, false
+	}
+	return sb.Atim.Nano(), sb.Ctim.Nano(), true
+}
@@ -0,0 +1,15 @@
+//go:build !linux && !openbsd && !solaris && !aix && !darwin && !freebsd && !netbsd && !dragonfly
+
+package importer
+
+import (
+	"io/fs"
+)
+
+func statIdentity(info fs.FileInfo) (dev, ino uint64, ctime int64, ok bool) {
+	return 0, 0, 0, false
+}
+
+func statTimes(info fs.FileInfo) (atime, ctime int64, ok bool) {
+	return 0, 0, false
+}
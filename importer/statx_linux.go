@@ -0,0 +1,131 @@
+//go:build linux
+
+package importer
+
+import (
+	"errors"
+	"io/fs"
+	"os"
+	"sync/atomic"
+	"syscall"
+	"time"
+
+	"golang.org/x/sys/unix"
+)
+
+// statxMask asks for what the walk records, and nothing else.
+const statxMask = unix.STATX_TYPE | unix.STATX_MODE | unix.STATX_NLINK |
+	unix.STATX_UID | unix.STATX_GID | unix.STATX_ATIME | unix.STATX_MTIME |
+	unix.STATX_CTIME | unix.STATX_INO | unix.STATX_SIZE | unix.STATX_BLOCKS |
+	unix.STATX_BTIME
+
+var noStatx atomic.Bool
+
+// statxEntry stats a directory entry relative to the descriptor of its
+// directory, which spares the kernel a lookup of the whole path.
+type statxEntry struct {
+	fs.DirEntry
+	dirfd int
+}
+
+// statxEntries arranges for the entries read from dir to be stat'ed
+// with statx when asked for their Info.  dir must remain open until
+// then.
+func statxEntries(dir *os.File, entries []fs.DirEntry) {
+	if noStatx.Load() {
+		return
+	}
+	dirfd := int(dir.Fd())
+	for i, entry := range entries {
+		entries[i] = statxEntry{DirEntry: entry, dirfd: dirfd}
+	}
+}
+
+func (e statxEntry) Info() (fs.FileInfo, error) {
+	var stx unix.Statx_t
+	err := unix.Statx(e.dirfd, e.Name(), unix.AT_SYMLINK_NOFOLLOW|unix.AT_NO_AUTOMOUNT, statxMask, &stx)
+	if errors.Is(err, unix.ENOSYS) {
+		noStatx.Store(true)
+		return e.DirEntry.Info()
+	}
+	if err != nil {
+		return nil, &fs.PathError{Op: "statx", Path: e.Name(), Err: err}
+	}
+	return newStatxInfo(e.Name(), &stx), nil
+}
+
+// statxInfo is the fs.FileInfo of a statx call.  Its Sys is the
+// equivalent *syscall.Stat_t, as expected from an lstat.
+type statxInfo struct {
+	name  string
+	sys   syscall.Stat_t
+	btime time.Time // zero if the filesystem doesn't record it
+}
+
+func newStatxInfo(name string, stx *unix.Statx_t) *statxInfo {
+	fi := &statxInfo{name: name}
+	sb := &fi.sys
+
+	setInt(&sb.Dev, unix.Mkdev(stx.Dev_major, stx.Dev_minor))
+	setInt(&sb.Ino, stx.Ino)
+	setInt(&sb.Nlink, uint64(stx.Nlink))
+	setInt(&sb.Mode, uint64(stx.Mode))
+	setInt(&sb.Uid, uint64(stx.Uid))
+	setInt(&sb.Gid, uint64(stx.Gid))
+	setInt(&sb.Rdev, unix.Mkdev(stx.Rdev_major, stx.Rdev_minor))
+	setInt(&sb.Size, stx.Size)
+	setInt(&sb.Blksize, uint64(stx.Blksize))
+	setInt(&sb.Blocks, stx.Blocks)
+	sb.Atim = syscall.NsecToTimespec(statxNsec(stx.Atime))
+	sb.Mtim = syscall.NsecToTimespec(statxNsec(stx.Mtime))
+	sb.Ctim = syscall.NsecToTimespec(statxNsec(stx.Ctime))
+
+	if stx.Mask&unix.STATX_BTIME != 0 {
+		fi.btime = time.Unix(0, statxNsec(stx.Btime))
+	}
+	return fi
+}
+
+// setInt stores v in a Stat_t field, whose type depends on the
+// architecture.
+func setInt[T ~int32 | ~int64 | ~uint32 | ~uint64](dst *T, v uint64) {
+	*dst = T(v)
+}
+
+func statxNsec(ts unix.StatxTimestamp) int64 {
+	return ts.Sec*int64(time.Second) + int64(ts.Nsec)
+}
+
+func (fi *statxInfo) Name() string       { return fi.name }
+func (fi *statxInfo) Size() int64        { return int64(fi.sys.Size) }
+func (fi *statxInfo) ModTime() time.Time { return time.Unix(fi.sys.Mtim.Unix()) }
+func (fi *statxInfo) IsDir() bool        { return fi.Mode().IsDir() }
+func (fi *statxInfo) Sys() any           { return &fi.sys }
+
+func (fi *statxInfo) Mode() fs.FileMode {
+	mode := fs.FileMode(fi.sys.Mode & 0777)
+	switch fi.sys.Mode & syscall.S_IFMT {
+	case syscall.S_IFBLK:
+		mode |= fs.ModeDevice
+	case syscall.S_IFCHR:
+		mode |= fs.ModeDevice | fs.ModeCharDevice
+	case syscall.S_IFDIR:
+		mode |= fs.ModeDir
+	case syscall.S_IFIFO:
+		mode |= fs.ModeNamedPipe
+	case syscall.S_IFLNK:
+		mode |= fs.ModeSymlink
+	case syscall.S_IFSOCK:
+		mode |= fs.ModeSocket
+	}
+	if fi.sys.Mode&syscall.S_ISGID != 0 {
+		mode |= fs.ModeSetgid
+	}
+	if fi.sys.Mode&syscall.S_ISUID != 0 {
+		mode |= fs.ModeSetuid
+	}
+	if fi.sys.Mode&syscall.S_ISVTX != 0 {
+		mode |= fs.ModeSticky
+	}
+	return mode
+}
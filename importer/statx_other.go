@@ -0,0 +1,11 @@
+//go:build !linux
+
+package importer
+
+import (
+	"io/fs"
+	"os"
+)
+
+func statxEntries(dir *os.File, entries []fs.DirEntry) {
+}
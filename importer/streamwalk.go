@@ -0,0 +1,152 @@
+/*
+ * Copyright (c) 2023 Gilles Chehade <gilles@poolp.org>
+ *
+ * Permission to use, copy, modify, and distribute this software for any
+ * purpose with or without fee is hereby granted, provided that the above
+ * copyright notice and this permission notice appear in all copies.
+ *
+ * THE SOFTWARE IS PROVIDED "AS IS" AND THE AUTHOR DISCLAIMS ALL WARRANTIES
+ * WITH REGARD TO THIS SOFTWARE INCLUDING ALL IMPLIED WARRANTIES OF
+ * MERCHANTABILITY AND FITNESS. IN NO EVENT SHALL THE AUTHOR BE LIABLE FOR
+ * ANY SPECIAL, DIRECT, INDIRECT, OR CONSEQUENTIAL DAMAGES OR ANY DAMAGES
+ * WHATSOEVER RESULTING FROM LOSS OF USE, DATA OR PROFITS, WHETHER IN AN
+ * ACTION OF CONTRACT, NEGLIGENCE OR OTHER TORTIOUS ACTION, ARISING OUT OF
+ * OR IN CONNECTION WITH THE USE OR PERFORMANCE OF THIS SOFTWARE.
+ */
+
+package importer
+
+import (
+	"context"
+	"errors"
+	"io"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+)
+
+// streamWalkDir is filepath.WalkDir with entries stat'ed relative to
+// their directory where possible, and fn called on all the entries of
+// a directory before descending into any of them.  With batch > 0, directories are
+// read batch entries at a time, in directory order, instead of being
+// read and sorted whole: memory doesn't grow with the size of a
+// directory, but the directories being walked are kept open, one per
+// level.  Otherwise only the directory being read is open.
+func streamWalkDir(ctx context.Context, root string, batch int, fn fs.WalkDirFunc) error {
+	info, err := os.Lstat(root)
+	if err != nil {
+		err = fn(root, nil, err)
+	} else {
+		err = fn(root, fs.FileInfoToDirEntry(info), nil)
+	}
+	if err == nil && info != nil && info.IsDir() {
+		err = streamDir(ctx, root, batch, fn)
+	}
+	if errors.Is(err, filepath.SkipDir) || errors.Is(err, filepath.SkipAll) {
+		return nil
+	}
+	return err
+}
+
+func streamDir(ctx context.Context, dir string, batch int, fn fs.WalkDirFunc) error {
+	return readEntries(ctx, dir, batch, fn, func(path string, entry fs.DirEntry) error {
+		if entry.IsDir() {
+			return streamDir(ctx, path, batch, fn)
+		}
+		return nil
+	})
+}
+
+// readEntries calls fn on each entry of dir, then descend on those it
+// accepted.  With batch > 0, entries are read batch at a time in
+// directory order and dir stays open while descending, otherwise they
+// are read whole and sorted by name like filepath.WalkDir does, and
+// dir is closed as soon as fn is done with them.  Errors reading dir
+// are handed to fn.
+func readEntries(ctx context.Context, dir string, batch int, fn fs.WalkDirFunc, descend func(string, fs.DirEntry) error) error {
+	fp, err := os.Open(dir)
+	if err != nil {
+		return walkDirError(dir, fn, err)
+	}
+
+	if batch <= 0 {
+		entries, readErr := fp.ReadDir(-1)
+		sortDirEntries(entries)
+		statxEntries(fp, entries)
+		skipped, err := visitEntries(ctx, dir, entries, fn, fp.Close, descend)
+		if err != nil || skipped || readErr == nil {
+			return err
+		}
+		return walkDirError(dir, fn, readErr)
+	}
+
+	defer fp.Close()
+	for {
+		entries, readErr := fp.ReadDir(batch)
+		statxEntries(fp, entries)
+		skipped, err := visitEntries(ctx, dir, entries, fn, nil, descend)
+		switch {
+		case err != nil || skipped, readErr == io.EOF:
+			return err
+		case readErr != nil:
+			return walkDirError(dir, fn, readErr)
+		}
+	}
+}
+
+// visitEntries calls fn on entries of dir, then release if not nil,
+// then descend on the entries fn accepted.  The entries may be stat'ed
+// through dir, release must not run before fn is done with them.  It
+// reports whether fn skipped the rest of dir.
+func visitEntries(ctx context.Context, dir string, entries []fs.DirEntry, fn fs.WalkDirFunc, release func() error, descend func(string, fs.DirEntry) error) (bool, error) {
+	var skipped bool
+	var err error
+	accepted := entries[:0]
+	for _, entry := range entries {
+		if ctx.Err() != nil {
+			err = filepath.SkipAll
+			break
+		}
+		if err = fn(filepath.Join(dir, entry.Name()), entry, nil); err != nil {
+			if errors.Is(err, filepath.SkipDir) {
+				if entry.IsDir() {
+					err = nil
+					continue
+				}
+				skipped, err = true, nil
+			}
+			break
+		}
+		accepted = append(accepted, entry)
+	}
+	if release != nil {
+		release()
+	}
+	if err != nil {
+		return false, err
+	}
+
+	for _, entry := range accepted {
+		if err := descend(filepath.Join(dir, entry.Name()), entry); err != nil {
+			return false, err
+		}
+	}
+	return skipped, nil
+}
+
+// walkDirError reports a failure to read dir the way filepath.WalkDir
+// does, by calling fn a second time on the directory.
+func walkDirError(dir string, fn fs.WalkDirFunc, err error) error {
+	if err := fn(dir, nil, err); err != nil && !errors.Is(err, filepath.SkipDir) {
+		return err
+	}
+	return nil
+}
+
+func sortDirEntries(entries []fs.DirEntry) {
+	slices.SortFunc(entries, func(a, b fs.DirEntry) int {
+		return strings.Compare(a.Name(), b.Name())
+	})
+}
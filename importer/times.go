@@ -0,0 +1,40 @@
+/*
+ * Copyright (c) 2023 Gilles Chehade <gilles@poolp.org>
+ *
+ * Permission to use, copy, modify, and distribute this software for any
+ * purpose with or without fee is hereby granted, provided that the above
+ * copyright notice and this permission notice appear in all copies.
+ *
+ * THE SOFTWARE IS PROVIDED "AS IS" AND THE AUTHOR DISCLAIMS ALL WARRANTIES
+ * WITH REGARD TO THIS SOFTWARE INCLUDING ALL IMPLIED WARRANTIES OF
+ * MERCHANTABILITY AND FITNESS. IN NO EVENT SHALL THE AUTHOR BE LIABLE FOR
+ * ANY SPECIAL, DIRECT, INDIRECT, OR CONSEQUENTIAL DAMAGES OR ANY DAMAGES
+ * WHATSOEVER RESULTING FROM LOSS OF USE, DATA OR PROFITS, WHETHER IN AN
+ * ACTION OF CONTRACT, NEGLIGENCE OR OTHER TORTIOUS ACTION, ARISING OUT OF
+ * OR IN CONNECTION WITH THE USE OR PERFORMANCE OF THIS SOFTWARE.
+ */
+
+package importer
+
+import (
+	"encoding/json"
+	"io/fs"
+
+	"github.com/PlakarKorp/integration-fs/internal/wire"
+)
+
+// timesAttribute returns the value of the times record of the file at
+// path, as stat'ed in info.
+func timesAttribute(path string, info fs.FileInfo) ([]byte, error) {
+	t := wire.Times{
+		Mtime: info.ModTime().UnixNano(),
+	}
+	if atime, ctime, ok := statTimes(info); ok {
+		t.Atime = atime
+		t.Ctime = ctime
+	}
+	if btime, ok := birthTime(path, info); ok {
+		t.Btime = btime
+	}
+	return json.Marshal(t)
+}
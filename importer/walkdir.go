@@ -18,14 +18,18 @@ package importer
 
 import (
 	"bytes"
+	"errors"
 	"fmt"
 	"io"
+	"io/fs"
 	"os"
 	"path/filepath"
 	"runtime"
 	"strings"
 	"sync"
+	"syscall"
 
+	"github.com/PlakarKorp/integration-fs/internal/wire"
 	"github.com/PlakarKorp/kloset/connectors"
 	"github.com/PlakarKorp/kloset/objects"
 	"github.com/pkg/xattr"
@@ -36,18 +40,26 @@ func (f *FSImporter) walkDir_worker(jobs <-chan file, records chan<- *connectors
 	defer wg.Done()
 
 	for p := range jobs {
+		origin := p.origin
+
 		var extendedAttributes []string
+		var originFile string
 		var err error
 
-		if !f.noxattr {
+		fileinfo := objects.FileInfoFromStat(p.info)
+		fileinfo.Lusername, fileinfo.Lgroupname = f.lookupIDs(fileinfo.Uid(), fileinfo.Gid())
+
+		if !f.noxattr && f.xattrSupported(p.info) {
 			extendedAttributes, err = xattr.LList(p.path)
-			if err != nil {
+			if errors.Is(err, syscall.ENOTSUP) {
+				f.noXattrSupport(p.info)
+			} else if err != nil {
 				errString := err.Error()
 				_, after, found := strings.Cut(errString, "xattr.list "+p.path+": ")
 				if found {
 					errString = after
 				}
-				records <- connectors.NewError(p.path, fmt.Errorf("%s", errString))
+				records <- connectors.NewError(origin, fmt.Errorf("%s", errString))
 
 				// continue handling the file if getxattr
 				// failed.  some sythetic filesystems (fuse)
@@ -56,24 +68,43 @@ func (f *FSImporter) walkDir_worker(jobs <-chan file, records chan<- *connectors
 			}
 		}
 
-		fileinfo := objects.FileInfoFromStat(p.info)
-		fileinfo.Lusername, fileinfo.Lgroupname = f.lookupIDs(fileinfo.Uid(), fileinfo.Gid())
+		if p.info.Mode().IsRegular() && isSparse(p.path, p.info) {
+			fileinfo.Flags |= wire.FlagSparse
+		}
 
-		var originFile string
 		if p.info.Mode()&os.ModeSymlink != 0 {
 			originFile, err = os.Readlink(p.path)
 			if err != nil {
-				records <- connectors.NewError(p.path, err)
+				records <- connectors.NewError(origin, err)
 				continue
 			}
 		}
 
-		entrypath := toslash(p.path)
+		read, err := f.contentReader(p, &fileinfo)
+		if err != nil {
+			records <- connectors.NewError(origin, err)
+			continue
+		}
+
+		entrypath := toslash(origin)
 
-		records <- connectors.NewRecord(entrypath, originFile, fileinfo, extendedAttributes,
-			func() (io.ReadCloser, error) {
-				return os.Open(p.path)
-			})
+		var times []byte
+		if f.recordTimes {
+			times, err = timesAttribute(p.path, p.info)
+			if err != nil {
+				records <- connectors.NewError(origin, err)
+				continue
+			}
+			fileinfo.Flags |= wire.FlagTimes
+		}
+
+		records <- connectors.NewRecord(entrypath, originFile, fileinfo, extendedAttributes, read)
+		if times != nil {
+			records <- connectors.NewXattr(entrypath, wire.TimesName, wire.AttributeTimes,
+				func() (io.ReadCloser, error) {
+					return io.NopCloser(bytes.NewReader(times)), nil
+				})
+		}
 		for _, attr := range extendedAttributes {
 			records <- connectors.NewXattr(entrypath, attr, objects.AttributeExtended,
 				func() (io.ReadCloser, error) {
@@ -87,8 +118,94 @@ func (f *FSImporter) walkDir_worker(jobs <-chan file, records chan<- *connectors
 	}
 }
 
-func walkDir_addPrefixDirectories(root string, records chan<- *connectors.Record) {
+// xattrSupported tells whether the filesystem holding info may have
+// extended attributes: listing them is skipped on filesystems known
+// not to support them.
+func (f *FSImporter) xattrSupported(info fs.FileInfo) bool {
+	dev, _, _, ok := statIdentity(info)
+	if !ok {
+		return true
+	}
+	_, unsupported := f.noXattrDevs.Load(dev)
+	return !unsupported
+}
+
+func (f *FSImporter) noXattrSupport(info fs.FileInfo) {
+	if dev, _, _, ok := statIdentity(info); ok {
+		f.noXattrDevs.Store(dev, struct{}{})
+	}
+}
+
+// contentReader returns the opener for the content of p.  Named
+// pipes, sockets and device nodes are never opened: reading them
+// could block forever or go through a whole disk.  They are recorded
+// as metadata only, unless block devices were explicitly requested,
+// in which case they are recorded as regular files holding the device
+// contents.
+func (f *FSImporter) contentReader(p file, fileinfo *objects.FileInfo) (func() (io.ReadCloser, error), error) {
+	mode := p.info.Mode()
+
+	open := func() (io.ReadCloser, error) {
+		return os.Open(p.path)
+	}
+
+	if mode.IsRegular() {
+		if f.changed.retries > 0 {
+			staged, err := f.stage(p, fileinfo)
+			if err != nil {
+				return nil, err
+			}
+			return func() (io.ReadCloser, error) {
+				return staged, nil
+			}, nil
+		}
+		return func() (io.ReadCloser, error) {
+			return f.openChecked(p)
+		}, nil
+	}
+
+	if mode&(os.ModeNamedPipe|os.ModeSocket|os.ModeDevice|os.ModeCharDevice|os.ModeIrregular) == 0 {
+		return open, nil
+	}
+
+	isBlockDevice := mode&os.ModeDevice != 0 && mode&os.ModeCharDevice == 0
+	if isBlockDevice && f.readblkdev {
+		size, err := blockDeviceSize(p.path)
+		if err != nil {
+			return nil, err
+		}
+		fileinfo.Lmode = mode.Perm()
+		fileinfo.Lsize = size
+		return open, nil
+	}
+
+	if mode&os.ModeDevice != 0 {
+		fileinfo.Lsize = deviceNumber(p.info)
+	}
+	return func() (io.ReadCloser, error) {
+		return nil, fmt.Errorf("%s: not a regular file", p.path)
+	}, nil
+}
+
+func blockDeviceSize(path string) (int64, error) {
+	fp, err := os.Open(path)
+	if err != nil {
+		return 0, err
+	}
+	defer fp.Close()
+
+	return fp.Seek(0, io.SeekEnd)
+}
+
+// walkDir_addPrefixDirectories emits root and its parents, up to the
+// first one found in seen.
+func walkDir_addPrefixDirectories(root string, records chan<- *connectors.Record, seen map[string]bool) {
 	for {
+		if seen[root] {
+			return
+		}
+		seen[root] = true
+
 		var finfo objects.FileInfo
 
 		sb, err := os.Lstat(root)
@@ -111,7 +228,8 @@ func walkDir_addPrefixDirectories(root string, records chan<- *connectors.Record
 		root = newroot
 	}
 
-	if runtime.GOOS == "windows" {
+	if runtime.GOOS == "windows" && !seen["/"] {
+		seen["/"] = true
 		finfo := objects.FileInfo{
 			Lname: "/",
 			Lmode: os.ModeDir | 0755,
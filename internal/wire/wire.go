@@ -0,0 +1,63 @@
+/*
+ * Copyright (c) 2023 Gilles Chehade <gilles@poolp.org>
+ *
+ * Permission to use, copy, modify, and distribute this software for any
+ * purpose with or without fee is hereby granted, provided that the above
+ * copyright notice and this permission notice appear in all copies.
+ *
+ * THE SOFTWARE IS PROVIDED "AS IS" AND THE AUTHOR DISCLAIMS ALL WARRANTIES
+ * WITH REGARD TO THIS SOFTWARE INCLUDING ALL IMPLIED WARRANTIES OF
+ * MERCHANTABILITY AND FITNESS. IN NO EVENT SHALL THE AUTHOR BE LIABLE FOR
+ * ANY SPECIAL, DIRECT, INDIRECT, OR CONSEQUENTIAL DAMAGES OR ANY DAMAGES
+ * WHATSOEVER RESULTING FROM LOSS OF USE, DATA OR PROFITS, WHETHER IN AN
+ * ACTION OF CONTRACT, NEGLIGENCE OR OTHER TORTIOUS ACTION, ARISING OUT OF
+ * OR IN CONNECTION WITH THE USE OR PERFORMANCE OF THIS SOFTWARE.
+ */
+
+// Package wire defines how the fs importer passes the exporter the
+// metadata that objects.FileInfo has no field for.
+package wire
+
+import "github.com/PlakarKorp/kloset/objects"
+
+// Bits of FileInfo.Flags.
+const (
+	FlagSparse = 1 << 0 // regular file with holes
+	FlagTimes  = 1 << 1 // a times record follows
+)
+
+// AttributeTimes is the attribute type of the records carrying Times.
+// It's none of the types kloset defines, which keeps these records
+// apart from extended attributes: no real attribute name can clash
+// with them.
+const AttributeTimes objects.Attribute = 0x80
+
+// TimesName is the name of the times records.
+const TimesName = "times"
+
+// Times are the timestamps of a file, in nanoseconds since the epoch.
+// Those the system doesn't provide are left out; the change and birth
+// times can't be restored.
+type Times struct {
+	Atime int64 `json:"atime,omitempty"`
+	Mtime int64 `json:"mtime"`
+	Ctime int64 `json:"ctime,omitempty"`
+	Btime int64 `json:"btime,omitempty"`
+}
+
+// EncodeDev packs the device number of a device node, with the layout
+// of glibc's makedev().  It's carried in FileInfo.Lsize, which device
+// nodes have no use for.
+func EncodeDev(major, minor uint32) int64 {
+	dev := uint64(major&0xfffff000)<<32 | uint64(major&0xfff)<<8 |
+		uint64(minor&0xffffff00)<<12 | uint64(minor&0xff)
+	return int64(dev)
+}
+
+// DecodeDev unpacks a device number packed by EncodeDev.
+func DecodeDev(dev int64) (major, minor uint32) {
+	d := uint64(dev)
+	major = uint32((d>>8)&0xfff) | uint32(d>>32)&0xfffff000
+	minor = uint32(d&0xff) | uint32(d>>12)&0xffffff00
+	return major, minor
+}
@@ -29,12 +29,20 @@ import (
 )
 
 type Buckets struct {
-	path string
+	path       string
+	durability Durability
 }
 
 func NewBuckets(path string) Buckets {
+	return NewBucketsDurability(path, DurabilityNone)
+}
+
+// NewBucketsDurability returns buckets whose writes have the given
+// durability.
+func NewBucketsDurability(path string, durability Durability) Buckets {
 	return Buckets{
-		path: path,
+		path:       path,
+		durability: durability,
 	}
 }
 
@@ -151,5 +159,5 @@ func (buckets *Buckets) Put(mac objects.MAC, rd io.Reader) (int64, error) {
 		return 0, err
 	}
 
-	return WriteToFileAtomicTempDir(p, rd, buckets.path)
+	return WriteToFileAtomicTempDirDurability(p, rd, buckets.path, buckets.durability)
 }
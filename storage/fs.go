@@ -35,9 +35,10 @@ import (
 )
 
 type Store struct {
-	location  string
-	packfiles Buckets
-	states    Buckets
+	location   string
+	durability Durability
+	packfiles  Buckets
+	states     Buckets
 }
 
 func init() {
@@ -45,8 +46,14 @@ func init() {
 }
 
 func NewStore(ctx context.Context, proto string, storeConfig map[string]string) (storage.Store, error) {
+	durability, err := ParseDurability(storeConfig["durability"])
+	if err != nil {
+		return nil, err
+	}
+
 	return &Store{
-		location: strings.TrimPrefix(storeConfig["location"], proto+"://"),
+		location:   strings.TrimPrefix(storeConfig["location"], proto+"://"),
+		durability: durability,
 	}, nil
 }
 
@@ -88,12 +95,12 @@ func (s *Store) Create(ctx context.Context, config []byte) error {
 		}
 	}
 
-	s.packfiles = NewBuckets(s.Path("packfiles"))
+	s.packfiles = NewBucketsDurability(s.Path("packfiles"), s.durability)
 	if err := s.packfiles.Create(); err != nil {
 		return err
 	}
 
-	s.states = NewBuckets(s.Path("states"))
+	s.states = NewBucketsDurability(s.Path("states"), s.durability)
 	if err := s.states.Create(); err != nil {
 		return err
 	}
@@ -103,13 +110,13 @@ func (s *Store) Create(ctx context.Context, config []byte) error {
 		return err
 	}
 
-	_, err = WriteToFileAtomic(s.Path("CONFIG"), bytes.NewReader(config))
+	_, err = WriteToFileAtomicDurability(s.Path("CONFIG"), bytes.NewReader(config), s.durability)
 	return err
 }
 
 func (s *Store) Open(ctx context.Context) ([]byte, error) {
-	s.packfiles = NewBuckets(s.Path("packfiles"))
-	s.states = NewBuckets(s.Path("states"))
+	s.packfiles = NewBucketsDurability(s.Path("packfiles"), s.durability)
+	s.states = NewBucketsDurability(s.Path("states"), s.durability)
 
 	rd, err := os.Open(s.Path("CONFIG"))
 	if err != nil {
@@ -253,7 +260,7 @@ func (s *Store) getLocks(ctx context.Context) ([]objects.MAC, error) {
 }
 
 func (s *Store) putLock(ctx context.Context, lockID objects.MAC, rd io.Reader) (int64, error) {
-	return WriteToFileAtomicTempDir(filepath.Join(s.Path("locks"), hex.EncodeToString(lockID[:])), rd, s.Path(""))
+	return WriteToFileAtomicTempDirDurability(filepath.Join(s.Path("locks"), hex.EncodeToString(lockID[:])), rd, s.Path(""), s.durability)
 }
 
 func (s *Store) getLock(ctx context.Context, lockID objects.MAC) (io.ReadCloser, error) {
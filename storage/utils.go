@@ -17,16 +17,56 @@
 package storage
 
 import (
+	"fmt"
 	"io"
 	"os"
 	"path/filepath"
+	"runtime"
 )
 
+// Durability tells how hard WriteToFileAtomic tries to have the data
+// on stable storage before returning.
+type Durability int
+
+const (
+	// DurabilityNone leaves it to the operating system.
+	DurabilityNone Durability = iota
+	// DurabilityFile syncs the file before renaming it into place.
+	DurabilityFile
+	// DurabilityFull also syncs the directory holding the file after
+	// the rename, so that the new entry survives a crash.
+	DurabilityFull
+)
+
+func ParseDurability(s string) (Durability, error) {
+	switch s {
+	case "", "none":
+		return DurabilityNone, nil
+	case "file":
+		return DurabilityFile, nil
+	case "file+dir":
+		return DurabilityFull, nil
+	}
+	return 0, fmt.Errorf("invalid durability %q", s)
+}
+
 func WriteToFileAtomic(filename string, rd io.Reader) (int64, error) {
 	return WriteToFileAtomicTempDir(filename, rd, filepath.Dir(filename))
 }
 
 func WriteToFileAtomicTempDir(filename string, rd io.Reader, tmpdir string) (int64, error) {
+	return WriteToFileAtomicTempDirDurability(filename, rd, tmpdir, DurabilityNone)
+}
+
+// WriteToFileAtomicDurability is WriteToFileAtomic with the given
+// durability.
+func WriteToFileAtomicDurability(filename string, rd io.Reader, durability Durability) (int64, error) {
+	return WriteToFileAtomicTempDirDurability(filename, rd, filepath.Dir(filename), durability)
+}
+
+// WriteToFileAtomicTempDirDurability is WriteToFileAtomicTempDir with
+// the given durability.
+func WriteToFileAtomicTempDirDurability(filename string, rd io.Reader, tmpdir string, durability Durability) (int64, error) {
 	f, err := os.CreateTemp(tmpdir, "tmp.")
 	if err != nil {
 		return 0, err
@@ -39,6 +79,14 @@ func WriteToFileAtomicTempDir(filename string, rd io.Reader, tmpdir string) (int
 		return 0, err
 	}
 
+	if durability >= DurabilityFile {
+		if err = f.Sync(); err != nil {
+			f.Close()
+			os.Remove(f.Name())
+			return 0, err
+		}
+	}
+
 	if err = f.Close(); err != nil {
 		os.Remove(f.Name())
 		return 0, err
@@ -50,5 +98,27 @@ func WriteToFileAtomicTempDir(filename string, rd io.Reader, tmpdir string) (int
 		return 0, err
 	}
 
+	if durability >= DurabilityFull {
+		if err = SyncDir(filepath.Dir(filename)); err != nil {
+			return 0, err
+		}
+	}
+
 	return nbytes, nil
 }
+
+// SyncDir flushes the entries of a directory to stable storage.
+// Directories can't be synced on windows, where it's a no-op.
+func SyncDir(path string) error {
+	if runtime.GOOS == "windows" {
+		return nil
+	}
+
+	dir, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer dir.Close()
+
+	return dir.Sync()
+}